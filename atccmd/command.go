@@ -99,6 +99,8 @@ type RunCommand struct {
 
 	InterceptIdleTimeout time.Duration `long:"intercept-idle-timeout" default:"0m" description:"Length of time for a intercepted session to be idle before terminating."`
 
+	DatabaseWaitTimeout time.Duration `long:"database-wait-timeout" default:"0m" description:"Length of time to wait for the database to accept connections on startup. 0 waits forever."`
+
 	GlobalResourceCheckTimeout   time.Duration `long:"global-resource-check-timeout" default:"1h" description:"Time limit on checking for new versions of resources."`
 	ResourceCheckingInterval     time.Duration `long:"resource-checking-interval" default:"1m" description:"Interval on which to check for new versions of resources."`
 	ResourceTypeCheckingInterval time.Duration `long:"resource-type-checking-interval" default:"1m" description:"Interval on which to check for new versions of resource types."`
@@ -244,11 +246,19 @@ func (cmd *Migration) migrateDBToVersion() error {
 		strategy,
 	)
 
-	err := helper.MigrateToVersion(version)
+	result, err := helper.MigrateToVersionWithResult(version)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Could not migrate to version: %d Reason: %s", version, err.Error()))
 	}
 
+	if result.UpgradedFromLegacy {
+		fmt.Println("Upgraded from legacy Concourse 3.6.0 schema")
+	}
+
+	for _, applied := range result.Applied {
+		fmt.Println("Applied migration:", applied)
+	}
+
 	fmt.Println("Successfully migrated to version:", version)
 	return nil
 }
@@ -1053,7 +1063,7 @@ func (cmd *RunCommand) constructDBConn(
 	connectionName string,
 	lockFactory lock.LockFactory,
 ) (db.Conn, error) {
-	dbConn, err := db.Open(logger.Session("db"), driverName, cmd.Postgres.ConnectionString(), cmd.newKey(), cmd.oldKey(), connectionName, lockFactory)
+	dbConn, err := db.Open(logger.Session("db"), driverName, cmd.Postgres.ConnectionString(), cmd.newKey(), cmd.oldKey(), connectionName, lockFactory, cmd.DatabaseWaitTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %s", err)
 	}
@@ -52,6 +52,10 @@ func NewDatabaseMigrationLockID() LockID {
 	return LockID{LockTypeDatabaseMigration}
 }
 
+func NewNamedDatabaseMigrationLockID(name string) LockID {
+	return LockID{LockTypeDatabaseMigration, lockIDFromString(name)}
+}
+
 //go:generate counterfeiter . LockFactory
 
 type LockFactory interface {
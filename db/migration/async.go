@@ -0,0 +1,89 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrMigrationInProgress is returned by StartAsync while an earlier
+// asynchronous migration of the same migrator is still running.
+var ErrMigrationInProgress = errors.New("an asynchronous migration is already in progress")
+
+// MigrationHandle tracks a migration started with StartAsync.
+type MigrationHandle struct {
+	mutex sync.Mutex
+	done  int
+	total int
+	err   error
+
+	finished chan struct{}
+}
+
+// Progress returns the number of migration files applied so far and the
+// total number to apply. Both are zero until the first file is applied.
+func (h *MigrationHandle) Progress() (int, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.done, h.total
+}
+
+// Wait blocks until the migration finishes and returns its error.
+func (h *MigrationHandle) Wait() error {
+	<-h.finished
+	return h.Err()
+}
+
+// Err returns the error the migration failed with, or nil if it succeeded
+// or is still running.
+func (h *MigrationHandle) Err() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.err
+}
+
+func (h *MigrationHandle) reportProgress(done, total int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.done, h.total = done, total
+}
+
+func (h *MigrationHandle) finish(err error) {
+	h.mutex.Lock()
+	h.err = err
+	h.mutex.Unlock()
+
+	close(h.finished)
+}
+
+// StartAsync migrates to toVersion in the background, like Migrate, and
+// returns a handle to follow it by, e.g. from an HTTP handler. Only one
+// asynchronous migration runs per migrator at a time; the migration lock
+// still guards against other migrators.
+func (self *migrator) StartAsync(toVersion int) (*MigrationHandle, error) {
+	self.asyncMutex.Lock()
+	defer self.asyncMutex.Unlock()
+
+	if self.asyncRunning {
+		return nil, ErrMigrationInProgress
+	}
+
+	self.asyncRunning = true
+
+	handle := &MigrationHandle{finished: make(chan struct{})}
+
+	go func() {
+		_, err := self.migrate(context.Background(), toVersion, handle.reportProgress)
+
+		self.asyncMutex.Lock()
+		self.asyncRunning = false
+		self.asyncMutex.Unlock()
+
+		handle.finish(err)
+	}()
+
+	return handle, nil
+}
@@ -0,0 +1,32 @@
+package migration_test
+
+import (
+	"testing"
+
+	"github.com/concourse/atc/db/migration"
+)
+
+func BenchmarkSupportedVersion(b *testing.B) {
+	migrator := migration.NewMigrator(nil, nil, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := migrator.SupportedVersion()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSupportedVersions(b *testing.B) {
+	migrator := migration.NewMigrator(nil, nil, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		migrator.SupportedVersions()
+	}
+}
@@ -0,0 +1,76 @@
+package migration
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrorClassifier decides how the migrator reacts to a failed statement.
+//
+// A transactional migration whose error is retriable is run again from the
+// start, up to maxTransactionAttempts times. With WithSkipExistingIndexes, a
+// statement of a NO_TRANSACTION migration whose error is ignorable is skipped.
+type ErrorClassifier interface {
+	IsRetriable(err error) bool
+	IsIgnorable(err error) bool
+}
+
+// NewPostgresErrorClassifier returns the default ErrorClassifier. It retries
+// serialization failures, deadlocks and lock timeouts, and ignores errors
+// from creating objects that already exist.
+func NewPostgresErrorClassifier() ErrorClassifier {
+	return postgresErrorClassifier{}
+}
+
+type postgresErrorClassifier struct{}
+
+var retriableErrorCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available
+}
+
+var ignorableErrorCodes = map[pq.ErrorCode]bool{
+	"42P06": true, // duplicate_schema
+	"42P07": true, // duplicate_table
+	"42701": true, // duplicate_column
+	"42710": true, // duplicate_object
+	"42723": true, // duplicate_function
+}
+
+func (postgresErrorClassifier) IsRetriable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && retriableErrorCodes[pqErr.Code]
+}
+
+func (postgresErrorClassifier) IsIgnorable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && ignorableErrorCodes[pqErr.Code]
+}
+
+// isTransientConnError reports whether err is a connection failure that may
+// go away by itself, e.g. while the database restarts or fails over, as
+// opposed to an error that would recur on every attempt.
+func isTransientConnError(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		// class 08 is connection_exception, 57P01-57P03 are admin_shutdown,
+		// crash_shutdown and cannot_connect_now, and 53300 is
+		// too_many_connections
+		code := string(pqErr.Code)
+		return strings.HasPrefix(code, "08") || code == "57P01" || code == "57P02" || code == "57P03" || code == "53300"
+	}
+
+	return false
+}
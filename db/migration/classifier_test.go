@@ -0,0 +1,53 @@
+package migration_test
+
+import (
+	"errors"
+
+	"github.com/concourse/atc/db/migration"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeErrorClassifier struct {
+	retriable       bool
+	ignorable       bool
+	retriableChecks int
+	ignorableChecks int
+}
+
+func (c *fakeErrorClassifier) IsRetriable(err error) bool {
+	c.retriableChecks++
+	return c.retriable
+}
+
+func (c *fakeErrorClassifier) IsIgnorable(err error) bool {
+	c.ignorableChecks++
+	return c.ignorable
+}
+
+var _ = Describe("NewPostgresErrorClassifier", func() {
+	var classifier migration.ErrorClassifier
+
+	BeforeEach(func() {
+		classifier = migration.NewPostgresErrorClassifier()
+	})
+
+	It("retries serialization failures and deadlocks", func() {
+		Expect(classifier.IsRetriable(&pq.Error{Code: "40001"})).To(BeTrue())
+		Expect(classifier.IsRetriable(&pq.Error{Code: "40P01"})).To(BeTrue())
+		Expect(classifier.IsRetriable(&pq.Error{Code: "42P07"})).To(BeFalse())
+	})
+
+	It("ignores objects that already exist", func() {
+		Expect(classifier.IsIgnorable(&pq.Error{Code: "42P07"})).To(BeTrue())
+		Expect(classifier.IsIgnorable(&pq.Error{Code: "42710"})).To(BeTrue())
+		Expect(classifier.IsIgnorable(&pq.Error{Code: "23505"})).To(BeFalse())
+	})
+
+	It("neither retries nor ignores errors that did not come from postgres", func() {
+		err := errors.New("connection reset by peer")
+		Expect(classifier.IsRetriable(err)).To(BeFalse())
+		Expect(classifier.IsIgnorable(err)).To(BeFalse())
+	})
+})
@@ -2,11 +2,12 @@ package cli
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"text/template"
 	"time"
+
+	"github.com/concourse/atc/db/migration"
 )
 
 var defaultMigrationDir = "migrations/"
@@ -50,23 +51,8 @@ func (c *GenerateCommand) Execute(args []string) error {
 }
 
 func (c *GenerateCommand) GenerateSQLMigration() error {
-	currentTime := time.Now().Unix()
-	fileNameFormat := "%d_%s.%s.sql"
-
-	upMigrationFileName := fmt.Sprintf(fileNameFormat, currentTime, c.MigrationName, "up")
-	downMigrationFileName := fmt.Sprintf(fileNameFormat, currentTime, c.MigrationName, "down")
-
-	contents := ""
-
-	err := ioutil.WriteFile(path.Join(c.MigrationDirectory, upMigrationFileName), []byte(contents), os.ModePerm)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(path.Join(c.MigrationDirectory, downMigrationFileName), []byte(contents), os.ModePerm)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, _, err := migration.Generate(c.MigrationDirectory, c.MigrationName)
+	return err
 }
 
 type migrationInfo struct {
@@ -0,0 +1,262 @@
+package migration
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// Dialect captures the SQL that differs between the databases the migrator
+// can run against. Dialects are looked up by database/sql driver name; see
+// RegisterDialect. Postgres is the default; sqlite is only intended for
+// running migrations against an in-memory database in tests.
+//
+// Queries take their arguments as $1, $2, ... placeholders.
+type Dialect interface {
+	// Name identifies the dialect in the "-- atc:dialect" header of
+	// migrations that only run against some databases.
+	Name() string
+
+	// TableExistsQuery checks whether the table named by $1 exists.
+	TableExistsQuery() string
+
+	// CurrentVersionQuery selects the version and direction of the latest
+	// migration recorded in the named history table that did not fail.
+	CurrentVersionQuery(tableName string) string
+
+	// LatestFirst orders migrations_history rows from newest to oldest.
+	LatestFirst() string
+
+	// RowID names the column that uniquely identifies a row.
+	RowID() string
+
+	// HasLegacyTables reports whether databases may carry the version tables
+	// of the migrators used before migrations_history.
+	HasLegacyTables() bool
+
+	// CreateVersionTable creates the table that records the history of
+	// migrations, unless it already exists.
+	CreateVersionTable(tableName string) string
+
+	// CreateTimingsTable creates the named timings table, which records how
+	// long each migration took, unless it already exists.
+	CreateTimingsTable(tableName string) string
+
+	// CreateStateTable creates the table that holds a row while a migration
+	// is in progress, unless it already exists.
+	CreateStateTable(tableName string) string
+
+	// CreateProgressTable creates the table that records how many statements
+	// of a failed NO_TRANSACTION migration are done, unless it already exists.
+	CreateProgressTable(tableName string) string
+
+	// LockStrategy tells how migrations are serialized across migrators.
+	LockStrategy() LockStrategy
+}
+
+// LockStrategy is how a dialect serializes migrations across migrators.
+type LockStrategy int
+
+const (
+	// AdvisoryLock takes the migration lock from the migrator's
+	// lock.LockFactory, which holds a Postgres advisory lock.
+	AdvisoryLock LockStrategy = iota
+
+	// NoLock migrates without a lock, for databases without advisory locks.
+	// Deployments must then make sure only one migrator runs at a time.
+	NoLock
+)
+
+// TransactionRetrier is implemented by dialects of databases that require
+// clients to retry transactions failing with certain errors, re-executing
+// every statement from the beginning. The migrator does so for transactional
+// migrations regardless of its ErrorClassifier.
+type TransactionRetrier interface {
+	RetryTransaction(err error) bool
+}
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = map[string]Dialect{
+		"cockroach": cockroachDialect{},
+		"postgres":  postgresDialect{},
+		"sqlite3":   sqliteDialect{},
+	}
+)
+
+// RegisterDialect makes a dialect available to WithDriverName and
+// NewOpenHelper under the name of its database/sql driver. It panics if the
+// dialect is nil or a dialect is already registered for the driver.
+func RegisterDialect(driver string, dialect Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+
+	if dialect == nil {
+		panic("migration: RegisterDialect dialect is nil")
+	}
+
+	if _, found := dialects[driver]; found {
+		panic("migration: RegisterDialect called twice for driver " + driver)
+	}
+
+	dialects[driver] = dialect
+}
+
+// Dialects returns the sorted driver names of the registered dialects.
+func Dialects() []string {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+
+	drivers := []string{}
+	for driver := range dialects {
+		drivers = append(drivers, driver)
+	}
+	sort.Strings(drivers)
+
+	return drivers
+}
+
+// DialectForDriver returns the dialect registered for driver, falling back
+// to Postgres for drivers without one.
+func DialectForDriver(driver string) Dialect {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+
+	if dialect, found := dialects[driver]; found {
+		return dialect
+	}
+
+	return postgresDialect{}
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) TableExistsQuery() string {
+	return "SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1)"
+}
+
+func (d postgresDialect) CurrentVersionQuery(tableName string) string {
+	return "SELECT version, direction FROM " + tableName + " WHERE status!='failed' ORDER BY " + d.LatestFirst() + " LIMIT 1"
+}
+
+// rows recorded in one statement, e.g. by Baseline, share a timestamp and are
+// ordered by version instead.
+func (postgresDialect) LatestFirst() string {
+	return "tstamp DESC, version DESC"
+}
+
+func (postgresDialect) RowID() string {
+	return "ctid"
+}
+
+func (postgresDialect) HasLegacyTables() bool {
+	return true
+}
+
+func (postgresDialect) CreateVersionTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint, tstamp timestamp with time zone, direction varchar, status varchar, dirty boolean)"
+}
+
+func (postgresDialect) CreateTimingsTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint, direction varchar, tstamp timestamp with time zone, duration_ms bigint)"
+}
+
+func (postgresDialect) CreateStateTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (started_at timestamp with time zone)"
+}
+
+func (postgresDialect) CreateProgressTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version bigint, direction varchar, statement_index integer)"
+}
+
+func (postgresDialect) LockStrategy() LockStrategy {
+	return AdvisoryLock
+}
+
+// NewCockroachDialect returns the dialect for CockroachDB, which is also
+// registered for the "cockroach" driver. CockroachDB speaks the Postgres wire
+// protocol, so it is typically used through lib/pq with WithDialect.
+func NewCockroachDialect() Dialect {
+	return cockroachDialect{}
+}
+
+// cockroachDialect follows Postgres, except that CockroachDB has no ctid and
+// expects clients to retry transactions that fail with serialization errors.
+type cockroachDialect struct {
+	postgresDialect
+}
+
+func (cockroachDialect) Name() string {
+	return "cockroach"
+}
+
+func (cockroachDialect) RowID() string {
+	return "rowid"
+}
+
+func (cockroachDialect) HasLegacyTables() bool {
+	return false
+}
+
+// CockroachDB does not implement pg_advisory_lock.
+func (cockroachDialect) LockStrategy() LockStrategy {
+	return NoLock
+}
+
+func (cockroachDialect) RetryTransaction(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) TableExistsQuery() string {
+	return "SELECT EXISTS ( SELECT 1 FROM sqlite_master WHERE type='table' AND name=$1)"
+}
+
+func (d sqliteDialect) CurrentVersionQuery(tableName string) string {
+	return "SELECT version, direction FROM " + tableName + " WHERE status!='failed' ORDER BY " + d.LatestFirst() + " LIMIT 1"
+}
+
+// sqlite's current_timestamp only has second precision, so rows recorded
+// within the same second are ordered by insertion instead.
+func (sqliteDialect) LatestFirst() string {
+	return "tstamp DESC, rowid DESC"
+}
+
+func (sqliteDialect) RowID() string {
+	return "rowid"
+}
+
+func (sqliteDialect) HasLegacyTables() bool {
+	return false
+}
+
+func (sqliteDialect) CreateVersionTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version integer, tstamp timestamp, direction text, status text, dirty boolean)"
+}
+
+func (sqliteDialect) CreateTimingsTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version integer, direction text, tstamp timestamp, duration_ms integer)"
+}
+
+func (sqliteDialect) CreateStateTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (started_at timestamp)"
+}
+
+func (sqliteDialect) CreateProgressTable(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName + " (version integer, direction text, statement_index integer)"
+}
+
+func (sqliteDialect) LockStrategy() LockStrategy {
+	return NoLock
+}
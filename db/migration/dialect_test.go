@@ -0,0 +1,214 @@
+package migration_test
+
+import (
+	"database/sql"
+
+	"github.com/concourse/atc/db/encryption"
+	"github.com/concourse/atc/db/lock/lockfakes"
+	"github.com/concourse/atc/db/migration"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type customDialect struct {
+	migration.Dialect
+}
+
+var _ = Describe("Dialect", func() {
+	Context("DialectForDriver", func() {
+		It("selects the postgres dialect for postgres", func() {
+			Expect(migration.DialectForDriver("postgres").RowID()).To(Equal("ctid"))
+		})
+
+		It("selects the sqlite dialect for sqlite3", func() {
+			Expect(migration.DialectForDriver("sqlite3").RowID()).To(Equal("rowid"))
+		})
+
+		It("falls back to postgres for drivers without a dialect", func() {
+			Expect(migration.DialectForDriver("unregistered")).To(Equal(migration.DialectForDriver("postgres")))
+		})
+
+		It("selects registered dialects", func() {
+			dialect := customDialect{migration.DialectForDriver("postgres")}
+			migration.RegisterDialect("custom", dialect)
+
+			Expect(migration.DialectForDriver("custom")).To(Equal(dialect))
+			Expect(migration.Dialects()).To(ContainElement("custom"))
+		})
+	})
+
+	Context("RegisterDialect", func() {
+		It("panics when a dialect is registered twice for a driver", func() {
+			Expect(func() {
+				migration.RegisterDialect("postgres", customDialect{})
+			}).To(Panic())
+		})
+
+		It("panics when the dialect is nil", func() {
+			Expect(func() {
+				migration.RegisterDialect("nil-dialect", nil)
+			}).To(Panic())
+		})
+	})
+
+	Context("CurrentVersionQuery", func() {
+		It("selects the latest postgres version that did not fail", func() {
+			Expect(migration.DialectForDriver("postgres").CurrentVersionQuery("migrations_history")).To(Equal(
+				"SELECT version, direction FROM migrations_history WHERE status!='failed' ORDER BY tstamp DESC, version DESC LIMIT 1",
+			))
+		})
+
+		It("selects the latest sqlite version that did not fail", func() {
+			Expect(migration.DialectForDriver("sqlite3").CurrentVersionQuery("migrations_history")).To(Equal(
+				"SELECT version, direction FROM migrations_history WHERE status!='failed' ORDER BY tstamp DESC, rowid DESC LIMIT 1",
+			))
+		})
+	})
+
+	Context("CreateVersionTable", func() {
+		It("creates the postgres version table", func() {
+			Expect(migration.DialectForDriver("postgres").CreateVersionTable("migrations_history")).To(Equal(
+				"CREATE TABLE IF NOT EXISTS migrations_history (version bigint, tstamp timestamp with time zone, direction varchar, status varchar, dirty boolean)",
+			))
+		})
+
+		It("creates the sqlite version table", func() {
+			Expect(migration.DialectForDriver("sqlite3").CreateVersionTable("migrations_history")).To(Equal(
+				"CREATE TABLE IF NOT EXISTS migrations_history (version integer, tstamp timestamp, direction text, status text, dirty boolean)",
+			))
+		})
+
+		It("uses the given table name", func() {
+			Expect(migration.DialectForDriver("postgres").CreateVersionTable("other_history")).To(HavePrefix("CREATE TABLE IF NOT EXISTS other_history ("))
+		})
+	})
+
+	Context("CreateTimingsTable", func() {
+		It("creates the postgres timings table", func() {
+			Expect(migration.DialectForDriver("postgres").CreateTimingsTable("migration_timings")).To(Equal(
+				"CREATE TABLE IF NOT EXISTS migration_timings (version bigint, direction varchar, tstamp timestamp with time zone, duration_ms bigint)",
+			))
+		})
+
+		It("creates the sqlite timings table", func() {
+			Expect(migration.DialectForDriver("sqlite3").CreateTimingsTable("migration_timings")).To(Equal(
+				"CREATE TABLE IF NOT EXISTS migration_timings (version integer, direction text, tstamp timestamp, duration_ms integer)",
+			))
+		})
+	})
+
+	Context("LockStrategy", func() {
+		It("only takes advisory locks on postgres", func() {
+			Expect(migration.DialectForDriver("postgres").LockStrategy()).To(Equal(migration.AdvisoryLock))
+			Expect(migration.DialectForDriver("cockroach").LockStrategy()).To(Equal(migration.NoLock))
+			Expect(migration.DialectForDriver("sqlite3").LockStrategy()).To(Equal(migration.NoLock))
+		})
+	})
+
+	Context("CockroachDB", func() {
+		var (
+			fakeConn *sql.DB
+			migrator migration.Migrator
+		)
+
+		serializationFailure := &pq.Error{Code: "40001", Message: "restart transaction"}
+
+		BeforeEach(func() {
+			fakeDB.Reset()
+
+			var err error
+			fakeConn, err = sql.Open(fakeDriverName, "some-dsn")
+			Expect(err).NotTo(HaveOccurred())
+
+			migrator = migration.NewMigratorForMigrations(fakeConn, nil, encryption.NewNoEncryption(), NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql":   `CREATE TABLE teams (id integer); CREATE INDEX teams_id ON teams (id);`,
+				"1000_create_teams.down.sql": `DROP TABLE teams;`,
+			}), migration.WithDialect(migration.NewCockroachDialect()))
+		})
+
+		AfterEach(func() {
+			_ = fakeConn.Close()
+		})
+
+		It("is registered for the cockroach driver", func() {
+			Expect(migration.DialectForDriver("cockroach")).To(Equal(migration.NewCockroachDialect()))
+		})
+
+		It("migrates without taking the advisory lock", func() {
+			lockFactory := new(lockfakes.FakeLockFactory)
+			migrator = migration.NewMigratorForMigrations(fakeConn, lockFactory, encryption.NewNoEncryption(), NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql": `CREATE TABLE teams (id integer);`,
+			}), migration.WithDialect(migration.NewCockroachDialect()))
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(lockFactory.AcquireCallCount()).To(BeZero())
+		})
+
+		It("re-executes every statement of a transaction that fails with a serialization failure", func() {
+			fakeDB.FailExecs("CREATE INDEX teams_id ON teams (id)", serializationFailure)
+
+			Expect(migrator.Up()).To(Succeed())
+
+			var applied []string
+			for _, statement := range fakeDB.Execs() {
+				if statement == "CREATE TABLE teams (id integer)" || statement == "CREATE INDEX teams_id ON teams (id)" {
+					applied = append(applied, statement)
+				}
+			}
+
+			Expect(applied).To(Equal([]string{
+				"CREATE TABLE teams (id integer)",
+				"CREATE INDEX teams_id ON teams (id)",
+				"CREATE TABLE teams (id integer)",
+				"CREATE INDEX teams_id ON teams (id)",
+			}))
+		})
+
+		It("calls the OnRetry callback before retrying", func() {
+			type retry struct {
+				version, statementIndex, attempt int
+				err                              error
+			}
+
+			var retries []retry
+			migrator = migration.NewMigratorForMigrations(fakeConn, nil, encryption.NewNoEncryption(), NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql":   `CREATE TABLE teams (id integer); CREATE INDEX teams_id ON teams (id);`,
+				"1000_create_teams.down.sql": `DROP TABLE teams;`,
+			}), migration.WithDialect(migration.NewCockroachDialect()), migration.WithOnRetry(func(version, statementIndex, attempt int, err error) {
+				retries = append(retries, retry{version, statementIndex, attempt, err})
+			}))
+
+			fakeDB.FailExecs("CREATE INDEX teams_id ON teams (id)", serializationFailure)
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(retries).To(Equal([]retry{{1000, 2, 2, serializationFailure}}))
+		})
+
+		It("gives up once serialization failures keep occurring", func() {
+			failures := make([]error, 20)
+			for i := range failures {
+				failures[i] = serializationFailure
+			}
+			fakeDB.FailExecs("CREATE INDEX teams_id ON teams (id)", failures...)
+
+			err := migrator.Up()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("restart transaction"))
+		})
+
+		It("does not retry other errors", func() {
+			fakeDB.FailExecs("CREATE INDEX teams_id ON teams (id)", &pq.Error{Code: "42601", Message: "syntax error"})
+
+			Expect(migrator.Up()).To(MatchError(ContainSubstring("syntax error")))
+
+			creates := 0
+			for _, statement := range fakeDB.Execs() {
+				if statement == "CREATE TABLE teams (id integer)" {
+					creates++
+				}
+			}
+			Expect(creates).To(Equal(1))
+		})
+	})
+})
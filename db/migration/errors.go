@@ -0,0 +1,154 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrStoppedEarly is what a *StoppedEarlyError unwraps to, so that callers
+// can check for a stopped migration with errors.Is.
+var ErrStoppedEarly = errors.New("migration stopped before reaching the target version")
+
+// StoppedEarlyError is returned by Migrate when the channel given to
+// WithStopAfterCurrent is signalled before TargetVersion is reached, with
+// the database left at LastAppliedVersion.
+type StoppedEarlyError struct {
+	LastAppliedVersion int
+	TargetVersion      int
+}
+
+func (e *StoppedEarlyError) Error() string {
+	return fmt.Sprintf("%s: stopped at version %d on the way to %d", ErrStoppedEarly, e.LastAppliedVersion, e.TargetVersion)
+}
+
+func (e *StoppedEarlyError) Unwrap() error {
+	return ErrStoppedEarly
+}
+
+// ErrNoMigrations is returned when the migrator was built without any
+// migrations, which would otherwise make migrating silently do nothing.
+// WithAllowEmpty permits this.
+var ErrNoMigrations = errors.New("no migrations found")
+
+// ErrNoRowsAffected is the error of a MigrationError for a statement marked
+// with "-- expect: rows>0" that affected no rows.
+var ErrNoRowsAffected = errors.New("statement was expected to affect rows but affected none")
+
+// ErrNoChange is returned by Up and Migrate when the database is already at
+// the target version, so that callers can tell whether anything was migrated.
+var ErrNoChange = errors.New("no change")
+
+// ErrNoMoreMigrations is returned by UpOne and DownOne when there is no
+// migration left to apply or revert in that direction.
+var ErrNoMoreMigrations = errors.New("no more migrations")
+
+// MigrationError describes a migration that failed to apply. Statement is
+// set when the failure can be attributed to a single SQL statement, with
+// Statement.Line giving its starting line within the migration file and
+// StatementIndex its 1-based position among the migration's statements.
+type MigrationError struct {
+	Name           string
+	Version        int
+	Statement      Statement
+	StatementIndex int
+	RolledBack     bool
+	Err            error
+}
+
+func (e *MigrationError) Error() string {
+	msg := fmt.Sprintf("Migration '%s' failed", e.Name)
+
+	if e.Statement.Line > 0 {
+		msg += fmt.Sprintf(" at line %d", e.Statement.Line)
+	}
+
+	if e.StatementIndex > 0 {
+		msg += fmt.Sprintf(" (statement %d)", e.StatementIndex)
+	}
+
+	if e.RolledBack {
+		msg += ", rolled back the migration"
+	}
+
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// DowngradeError is returned by OpenHelper when opening the database would
+// require reverting migrations and AllowDowngrade is not set.
+type DowngradeError struct {
+	CurrentVersion int
+	TargetVersion  int
+}
+
+func (e *DowngradeError) Error() string {
+	return fmt.Sprintf("database is at version %d, which is newer than version %d; refusing to downgrade without AllowDowngrade", e.CurrentVersion, e.TargetVersion)
+}
+
+// IrreversibleMigrationError is returned when migrating down to
+// TargetVersion would have to revert Versions, which have no down
+// migrations. No migrations are run.
+type IrreversibleMigrationError struct {
+	Versions      []int
+	TargetVersion int
+}
+
+func (e *IrreversibleMigrationError) Error() string {
+	versions := make([]string, len(e.Versions))
+	for i, version := range e.Versions {
+		versions[i] = strconv.Itoa(version)
+	}
+
+	return fmt.Sprintf("cannot migrate down to version %d: no down migrations for versions %s", e.TargetVersion, strings.Join(versions, ", "))
+}
+
+// UnsupportedVersionError is returned by Up when the database is older than
+// the version set with WithMinSupportedVersion.
+type UnsupportedVersionError struct {
+	CurrentVersion      int
+	MinSupportedVersion int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("database version %d is older than the oldest supported version %d; upgrade through an intermediate release that supports it first", e.CurrentVersion, e.MinSupportedVersion)
+}
+
+// UnknownAppliedVersionsError is returned by Up when the database records
+// versions as applied that none of the migrations provide, typically because
+// it was migrated by a newer release.
+type UnknownAppliedVersionsError struct {
+	Versions []int
+}
+
+func (e *UnknownAppliedVersionsError) Error() string {
+	versions := []string{}
+	for _, version := range e.Versions {
+		versions = append(versions, strconv.Itoa(version))
+	}
+
+	return fmt.Sprintf("database has applied versions %s without a migration in this release; it was likely migrated by a newer release, which must be used instead", strings.Join(versions, ", "))
+}
+
+// underlyingError returns the database error behind a MigrationError.
+func underlyingError(err error) error {
+	if migrationErr, ok := err.(*MigrationError); ok {
+		return migrationErr.Err
+	}
+
+	return err
+}
+
+// UnknownSchemaVersionError is returned when no version is recorded for a
+// database that already has tables, e.g. after a legacy upgrade died before
+// recording the version it started from. Migrating from scratch would replay
+// migrations whose tables exist, so the version of the schema must be
+// recorded with Baseline first.
+type UnknownSchemaVersionError struct {
+	// Table is one of the existing tables.
+	Table string
+}
+
+func (e *UnknownSchemaVersionError) Error() string {
+	return fmt.Sprintf("no migration version is recorded, but the database already has tables such as %s; record the version its schema is at with Baseline before migrating", e.Table)
+}
@@ -0,0 +1,74 @@
+package migration
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/concourse/atc/db/lock"
+	"github.com/lib/pq"
+)
+
+// UpAsset exposes the up file lookup of a migrator to the tests.
+func UpAsset(m Migrator, version int) (string, bool) {
+	return m.(*migrator).upAsset(version)
+}
+
+// DownAsset exposes the down file lookup of a migrator to the tests.
+func DownAsset(m Migrator, version int) (string, bool) {
+	return m.(*migrator).downAsset(version)
+}
+
+// SetLockIntervals shortens how often a migrator polls for the migration lock
+// and logs that it is still waiting, so that tests need not wait seconds.
+func SetLockIntervals(m Migrator, poll, heartbeat time.Duration) {
+	m.(*migrator).lockPollInterval = poll
+	m.(*migrator).lockHeartbeatInterval = heartbeat
+}
+
+// MigrationsBetween exposes the versions a migrator would run to get from
+// current to target, and in which direction, to the tests.
+func MigrationsBetween(m Migrator, current, target int) ([]int, string, error) {
+	mig := m.(*migrator)
+
+	migrations, err := mig.Migrations()
+	if err != nil {
+		return nil, "", err
+	}
+
+	selected, direction, err := mig.migrationsBetween(current, target, migrations)
+	if err != nil {
+		return nil, direction, err
+	}
+
+	versions := []int{}
+	for _, m := range selected {
+		versions = append(versions, m.Version)
+	}
+
+	return versions, direction, nil
+}
+
+// AdvisoryLockHoldersQuery exposes the query ForceUnlock runs to the tests.
+func AdvisoryLockHoldersQuery(id lock.LockID) (string, []interface{}, error) {
+	return advisoryLockHoldersQuery(id)
+}
+
+// MigrateFromMigrationVersion exposes the upgrade from the legacy
+// migration_version table of an OpenHelper, on db, to the tests.
+func MigrateFromMigrationVersion(h *OpenHelper, db *sql.DB) (LegacyCheckResult, error) {
+	m := newMigrator(db, h.lockFactory, h.strategy, newMigrationsSource(), h.migratorOptions()...)
+	return h.migrateFromMigrationVersion(m)
+}
+
+// SetNoticeHandlerFunc replaces how a migrator sets the notice handler of a
+// connection, which is otherwise specific to lib/pq, for the fake driver.
+func SetNoticeHandlerFunc(m Migrator, setNoticeHandler func(driver.Conn, func(*pq.Error)) error) {
+	m.(*migrator).setNoticeHandler = setNoticeHandler
+}
+
+// CurrentVersionDirtyQuery exposes the query CurrentVersionDirty runs to the
+// tests.
+func CurrentVersionDirtyQuery(m Migrator) string {
+	return m.(*migrator).currentVersionDirtyQuery()
+}
@@ -0,0 +1,258 @@
+package migration_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+const fakeDriverName = "fake-migration-driver"
+
+var fakeDB = &fakeDriver{}
+
+func init() {
+	sql.Register(fakeDriverName, fakeDB)
+}
+
+type fakeDriver struct {
+	mutex sync.Mutex
+
+	pingErrors []error
+	pings      int
+
+	execErrors map[string][]error
+	execs      []string
+	queries    []string
+
+	queryRows map[string][]driver.Value
+	opened    []string
+	notices   map[string]*pq.Error
+}
+
+func (d *fakeDriver) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.pingErrors = nil
+	d.pings = 0
+	d.execErrors = nil
+	d.execs = nil
+	d.queries = nil
+	d.queryRows = nil
+	d.opened = nil
+	d.notices = nil
+}
+
+func (d *fakeDriver) FailPings(errs ...error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.pingErrors = errs
+}
+
+func (d *fakeDriver) Pings() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.pings
+}
+
+// FailExecs makes the next executions of query return errs, one per call.
+// Queries return no rows, except for SELECT EXISTS queries returning false.
+func (d *fakeDriver) FailExecs(query string, errs ...error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.execErrors == nil {
+		d.execErrors = map[string][]error{}
+	}
+
+	d.execErrors[query] = errs
+}
+
+// Execs returns every statement executed, in order.
+func (d *fakeDriver) Execs() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string{}, d.execs...)
+}
+
+// Queries returns every query run, in order.
+func (d *fakeDriver) Queries() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string{}, d.queries...)
+}
+
+// ReturnRow makes query return a single row of values rather than no rows.
+func (d *fakeDriver) ReturnRow(query string, values ...driver.Value) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.queryRows == nil {
+		d.queryRows = map[string][]driver.Value{}
+	}
+
+	d.queryRows[query] = values
+}
+
+// RaiseNotice makes executing query pass notice to the notice handler of the
+// connection it runs on, as set with SetNoticeHandler.
+func (d *fakeDriver) RaiseNotice(query string, notice *pq.Error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.notices == nil {
+		d.notices = map[string]*pq.Error{}
+	}
+
+	d.notices[query] = notice
+}
+
+// SetNoticeHandler sets the notice handler of a connection of the fake
+// driver, like pq.SetNoticeHandler does for lib/pq connections.
+func SetNoticeHandler(conn driver.Conn, handler func(*pq.Error)) error {
+	conn.(*fakeConn).noticeHandler = handler
+	return nil
+}
+
+// Opened returns the data source name of every connection opened, in order.
+func (d *fakeDriver) Opened() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string{}, d.opened...)
+}
+
+func (d *fakeDriver) exec(query string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.execs = append(d.execs, query)
+
+	if errs := d.execErrors[query]; len(errs) > 0 {
+		d.execErrors[query] = errs[1:]
+		return errs[0]
+	}
+
+	return nil
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.opened = append(d.opened, name)
+
+	return &fakeConn{driver: d}, nil
+}
+
+type fakeConn struct {
+	driver        *fakeDriver
+	noticeHandler func(*pq.Error)
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{driver: c.driver, conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.driver.mutex.Lock()
+	defer c.driver.mutex.Unlock()
+
+	c.driver.pings++
+
+	if len(c.driver.pingErrors) > 0 {
+		err := c.driver.pingErrors[0]
+		c.driver.pingErrors = c.driver.pingErrors[1:]
+		return err
+	}
+
+	return nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	driver *fakeDriver
+	conn   *fakeConn
+	query  string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	err := s.driver.exec(s.query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.driver.mutex.Lock()
+	notice := s.driver.notices[s.query]
+	s.driver.mutex.Unlock()
+
+	if notice != nil && s.conn.noticeHandler != nil {
+		s.conn.noticeHandler(notice)
+	}
+
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.mutex.Lock()
+	defer s.driver.mutex.Unlock()
+
+	s.driver.queries = append(s.driver.queries, s.query)
+
+	row, found := s.driver.queryRows[s.query]
+	if !found && strings.HasPrefix(s.query, "SELECT EXISTS") {
+		// like Postgres, EXISTS always returns a row
+		row = []driver.Value{false}
+	}
+
+	return &fakeRows{row: row}, nil
+}
+
+type fakeRows struct {
+	row []driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.row == nil {
+		return []string{"result"}
+	}
+
+	return make([]string, len(r.row))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+
+	copy(dest, r.row)
+	r.row = nil
+
+	return nil
+}
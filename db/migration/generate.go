@@ -0,0 +1,54 @@
+package migration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Generate creates empty up and down SQL migrations in dir, named
+// <timestamp>_<name>.up.sql and <timestamp>_<name>.down.sql so that both
+// share the version the parser will read back from them.
+func Generate(dir, name string) (upPath, downPath string, err error) {
+	if name == "" {
+		return "", "", fmt.Errorf("migration name must not be empty")
+	}
+
+	version := time.Now().Unix()
+
+	upPath = filepath.Join(dir, fmt.Sprintf("%d_%s.up.sql", version, name))
+	downPath = filepath.Join(dir, fmt.Sprintf("%d_%s.down.sql", version, name))
+
+	parser := NewParser(nil)
+	for _, path := range []string{upPath, downPath} {
+		m, err := parser.ParseMigrationFilename(filepath.Base(path))
+		if err != nil || int64(m.Version) != version {
+			return "", "", fmt.Errorf("migration name '%s' does not produce a parseable file name", name)
+		}
+	}
+
+	err = createEmptyFile(upPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = createEmptyFile(downPath)
+	if err != nil {
+		// an up migration without its down would be picked up by the next
+		// build, and would make the next Generate collide on the version
+		_ = os.Remove(upPath)
+		return "", "", err
+	}
+
+	return upPath, downPath, nil
+}
+
+func createEmptyFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
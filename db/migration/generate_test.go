@@ -0,0 +1,73 @@
+package migration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/concourse/atc/db/migration"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Generate", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "migrations")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	It("creates empty up and down migrations sharing a version", func() {
+		upPath, downPath, err := migration.Generate(dir, "create_some_table")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(filepath.Dir(upPath)).To(Equal(dir))
+		Expect(filepath.Dir(downPath)).To(Equal(dir))
+
+		parser := migration.NewParser(nil)
+
+		up, err := parser.ParseMigrationFilename(filepath.Base(upPath))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(up.Direction).To(Equal("up"))
+
+		down, err := parser.ParseMigrationFilename(filepath.Base(downPath))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(down.Direction).To(Equal("down"))
+
+		Expect(up.Version).To(Equal(down.Version))
+		Expect(filepath.Base(upPath)).To(MatchRegexp(`^\d+_create_some_table\.up\.sql$`))
+
+		contents, err := ioutil.ReadFile(upPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(BeEmpty())
+	})
+
+	It("removes the up migration if the down migration cannot be created", func() {
+		// the down migration of any version Generate may pick already exists
+		now := time.Now().Unix()
+		for version := now; version <= now+2; version++ {
+			err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d_create_some_table.down.sql", version)), nil, 0644)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		_, _, err := migration.Generate(dir, "create_some_table")
+		Expect(err).To(HaveOccurred())
+
+		upPaths, err := filepath.Glob(filepath.Join(dir, "*.up.sql"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(upPaths).To(BeEmpty())
+	})
+
+	It("rejects an empty name", func() {
+		_, _, err := migration.Generate(dir, "")
+		Expect(err).To(HaveOccurred())
+	})
+})
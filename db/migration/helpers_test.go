@@ -3,7 +3,9 @@ package migration_test
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 
+	"github.com/concourse/atc/db/migration/migrationfakes"
 	. "github.com/onsi/gomega"
 )
 
@@ -129,3 +131,22 @@ func fetchTeamLegacyAuth(dbConn *sql.DB, team string) map[string]interface{} {
 	Expect(err).NotTo(HaveOccurred())
 	return data
 }
+
+func NewMapBindata(assets map[string]string) *migrationfakes.FakeBindata {
+	bindata := new(migrationfakes.FakeBindata)
+	bindata.AssetNamesStub = func() []string {
+		names := []string{}
+		for name := range assets {
+			names = append(names, name)
+		}
+		return names
+	}
+	bindata.AssetStub = func(name string) ([]byte, error) {
+		contents, found := assets[name]
+		if !found {
+			return nil, errors.New("asset not found: " + name)
+		}
+		return []byte(contents), nil
+	}
+	return bindata
+}
@@ -0,0 +1,43 @@
+package migration
+
+import "code.cloudfoundry.org/lager"
+
+// Data carries the structured fields of a log line.
+type Data map[string]interface{}
+
+// Logger is the logging interface used by the migrator, so that it can log
+// through any logging stack. NewLagerLogger adapts a lager.Logger to it.
+type Logger interface {
+	Debug(action string, data ...Data)
+	Info(action string, data ...Data)
+	Error(action string, err error, data ...Data)
+}
+
+// NewLagerLogger returns a Logger that writes to the given lager.Logger.
+func NewLagerLogger(logger lager.Logger) Logger {
+	return &lagerLogger{logger}
+}
+
+type lagerLogger struct {
+	logger lager.Logger
+}
+
+func (l *lagerLogger) Debug(action string, data ...Data) {
+	l.logger.Debug(action, toLagerData(data)...)
+}
+
+func (l *lagerLogger) Info(action string, data ...Data) {
+	l.logger.Info(action, toLagerData(data)...)
+}
+
+func (l *lagerLogger) Error(action string, err error, data ...Data) {
+	l.logger.Error(action, err, toLagerData(data)...)
+}
+
+func toLagerData(data []Data) []lager.Data {
+	lagerData := make([]lager.Data, len(data))
+	for i, d := range data {
+		lagerData[i] = lager.Data(d)
+	}
+	return lagerData
+}
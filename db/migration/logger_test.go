@@ -0,0 +1,127 @@
+package migration_test
+
+import (
+	"errors"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/concourse/atc/db/migration"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordedLog struct {
+	Action string
+	Err    error
+	Data   migration.Data
+}
+
+type recordingLogger struct {
+	mutex sync.Mutex
+	logs  []recordedLog
+}
+
+func (l *recordingLogger) Debug(action string, data ...migration.Data) {
+	l.record(recordedLog{Action: action, Data: mergeData(data)})
+}
+
+func (l *recordingLogger) Info(action string, data ...migration.Data) {
+	l.record(recordedLog{Action: action, Data: mergeData(data)})
+}
+
+func (l *recordingLogger) Error(action string, err error, data ...migration.Data) {
+	l.record(recordedLog{Action: action, Err: err, Data: mergeData(data)})
+}
+
+func (l *recordingLogger) Actions() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	actions := []string{}
+	for _, log := range l.logs {
+		actions = append(actions, log.Action)
+	}
+	return actions
+}
+
+func (l *recordingLogger) Logs(action string) []recordedLog {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	logs := []recordedLog{}
+	for _, log := range l.logs {
+		if log.Action == action {
+			logs = append(logs, log)
+		}
+	}
+	return logs
+}
+
+func (l *recordingLogger) record(log recordedLog) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.logs = append(l.logs, log)
+}
+
+// cancellingLogger cancels a context once the given statement is about to be
+// applied, to interrupt a migration between two statements.
+type cancellingLogger struct {
+	recordingLogger
+
+	statement string
+	cancel    func()
+}
+
+func (l *cancellingLogger) Info(action string, data ...migration.Data) {
+	if action == "applying-statement" && mergeData(data)["statement"] == l.statement {
+		l.cancel()
+	}
+
+	l.recordingLogger.Info(action, data...)
+}
+
+// hookLogger calls hook before recording each logged action, to observe the
+// migrator at that point of a run.
+type hookLogger struct {
+	recordingLogger
+
+	hook func(action string)
+}
+
+func (l *hookLogger) Info(action string, data ...migration.Data) {
+	l.hook(action)
+	l.recordingLogger.Info(action, data...)
+}
+
+func mergeData(data []migration.Data) migration.Data {
+	merged := migration.Data{}
+	for _, d := range data {
+		for k, v := range d {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+var _ = Describe("NewLagerLogger", func() {
+	It("writes actions, errors and data to the lager logger", func() {
+		lagerLogger := lagertest.NewTestLogger("migrations-test")
+		logger := migration.NewLagerLogger(lagerLogger)
+
+		logger.Info("some-action", migration.Data{"version": 1000})
+		logger.Error("some-failure", errors.New("disaster"))
+
+		logs := lagerLogger.Logs()
+		Expect(logs).To(HaveLen(2))
+
+		Expect(logs[0].Message).To(Equal("migrations-test.some-action"))
+		Expect(logs[0].LogLevel).To(Equal(lager.INFO))
+		Expect(logs[0].Data["version"]).To(BeEquivalentTo(1000))
+
+		Expect(logs[1].Message).To(Equal("migrations-test.some-failure"))
+		Expect(logs[1].LogLevel).To(Equal(lager.ERROR))
+		Expect(logs[1].Data["error"]).To(Equal("disaster"))
+	})
+})
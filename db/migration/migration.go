@@ -1,10 +1,21 @@
 package migration
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -13,401 +24,3289 @@ import (
 	"github.com/concourse/atc/db/migration/migrations"
 	"github.com/gobuffalo/packr"
 	multierror "github.com/hashicorp/go-multierror"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-func NewOpenHelper(driver, name string, lockFactory lock.LockFactory, strategy encryption.Strategy) *OpenHelper {
+func NewOpenHelper(driver, name string, lockFactory lock.LockFactory, strategy encryption.Strategy, opts ...MigratorOption) *OpenHelper {
 	return &OpenHelper{
-		driver,
-		name,
-		lockFactory,
-		strategy,
+		driver:         driver,
+		dataSourceName: name,
+		lockFactory:    lockFactory,
+		strategy:       strategy,
+		opts:           opts,
+	}
+}
+
+// NewOpenHelperWithDB returns an OpenHelper that works on an already open
+// connection pool instead of opening its own. The helper never closes db.
+func NewOpenHelperWithDB(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy, opts ...MigratorOption) *OpenHelper {
+	return &OpenHelper{
+		db:          db,
+		lockFactory: lockFactory,
+		strategy:    strategy,
+		opts:        opts,
 	}
 }
 
 type OpenHelper struct {
+	// AllowDowngrade lets Open and OpenAtVersion run down migrations when the
+	// database is ahead of the version being opened, e.g. after rolling back
+	// to an older binary. Otherwise they fail with a *DowngradeError.
+	AllowDowngrade bool
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the pool the
+	// helper opens, as with the sql.DB methods of the same names; zero leaves
+	// the database/sql default. They do not apply to a pool given to
+	// NewOpenHelperWithDB.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// MaintenanceDatabase is the database EnsureDatabase connects to in order
+	// to create the one being opened. It defaults to "postgres".
+	MaintenanceDatabase string
+
 	driver         string
 	dataSourceName string
+	db             *sql.DB
 	lockFactory    lock.LockFactory
 	strategy       encryption.Strategy
+	opts           []MigratorOption
 }
 
-func (self *OpenHelper) CurrentVersion() (int, error) {
-	db, err := sql.Open(self.driver, self.dataSourceName)
-	if err != nil {
-		return -1, err
-	}
+// MigrateResult describes what a migration run changed, for the caller to
+// surface to operators.
+type MigrateResult struct {
+	// Direction is "up" or "down", depending on whether the target version
+	// was above or below the version the database started at.
+	Direction   string
+	FromVersion int
+	ToVersion   int
+
+	// Applied lists the filenames of the migrations that ran, in order. On
+	// failure it only includes the migrations that succeeded.
+	Applied []string
+
+	// AppliedVersions lists the versions of the migrations in Applied.
+	AppliedVersions []int
+
+	// UpgradedFromLegacy is set when the legacy migration_version table of a
+	// Concourse 3.6.0 database was dropped in favour of the current migrator.
+	UpgradedFromLegacy bool
+}
 
-	defer db.Close()
+func (r MigrateResult) unchanged() bool {
+	return len(r.Applied) == 0 && r.FromVersion == r.ToVersion
+}
 
-	return NewMigrator(db, self.lockFactory, self.strategy).CurrentVersion()
+func (self *OpenHelper) migratorOptions() []MigratorOption {
+	return append([]MigratorOption{WithDriverName(self.driver)}, self.opts...)
 }
 
-func (self *OpenHelper) SupportedVersion() (int, error) {
-	db, err := sql.Open(self.driver, self.dataSourceName)
-	if err != nil {
-		return -1, err
+func (self *OpenHelper) openDB() (*sql.DB, error) {
+	if self.db != nil {
+		return self.db, nil
 	}
 
-	defer db.Close()
-
-	return NewMigrator(db, self.lockFactory, self.strategy).SupportedVersion()
-}
+	if !isRegisteredDriver(self.driver) {
+		return nil, fmt.Errorf("unknown database driver %q (registered drivers: %s)", self.driver, strings.Join(sql.Drivers(), ", "))
+	}
 
-func (self *OpenHelper) Open() (*sql.DB, error) {
 	db, err := sql.Open(self.driver, self.dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := NewMigrator(db, self.lockFactory, self.strategy).Up(); err != nil {
-		_ = db.Close()
-		return nil, err
+	if self.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(self.MaxOpenConns)
 	}
 
-	return db, nil
-}
-
-func (self *OpenHelper) OpenAtVersion(version int) (*sql.DB, error) {
-	db, err := sql.Open(self.driver, self.dataSourceName)
-	if err != nil {
-		return nil, err
+	if self.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(self.MaxIdleConns)
 	}
 
-	if err := NewMigrator(db, self.lockFactory, self.strategy).Migrate(version); err != nil {
-		_ = db.Close()
-		return nil, err
+	if self.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(self.ConnMaxLifetime)
 	}
 
 	return db, nil
 }
 
-func (self *OpenHelper) MigrateToVersion(version int) error {
-	db, err := sql.Open(self.driver, self.dataSourceName)
-	if err != nil {
-		return err
+func isRegisteredDriver(driver string) bool {
+	for _, registered := range sql.Drivers() {
+		if registered == driver {
+			return true
+		}
 	}
 
-	defer db.Close()
-	m := NewMigrator(db, self.lockFactory, self.strategy)
+	return false
+}
 
-	err = self.migrateFromMigrationVersion(db)
-	if err != nil {
-		return err
+func (self *OpenHelper) closeDB(db *sql.DB) error {
+	if db == self.db {
+		return nil
 	}
 
-	return m.Migrate(version)
+	return db.Close()
 }
 
-func (self *OpenHelper) migrateFromMigrationVersion(db *sql.DB) error {
-
-	if !checkTableExist(db, "migration_version") {
-		return nil
+// WaitForDatabase pings the database, backing off between attempts, until it
+// accepts connections or the timeout elapses. A timeout of 0 waits until ctx
+// is done.
+func (self *OpenHelper) WaitForDatabase(ctx context.Context, timeout time.Duration) error {
+	db, err := self.openDB()
+	if err != nil {
+		return err
 	}
 
-	oldMigrationLastVersion := 189
-	newMigrationStartVersion := 1510262030
+	defer self.closeDB(db)
 
-	var err error
-	var dbVersion int
+	return waitForDatabase(ctx, db, timeout)
+}
 
-	if err = db.QueryRow("SELECT version FROM migration_version").Scan(&dbVersion); err != nil {
-		return err
+// EnsureDatabase creates the database named by the data source name if it
+// does not exist yet, e.g. on a fresh install, by connecting to
+// MaintenanceDatabase on the same server. It does nothing for a helper given
+// an open pool, whose database must exist.
+func (self *OpenHelper) EnsureDatabase() error {
+	if self.db != nil {
+		return nil
 	}
 
-	if dbVersion != oldMigrationLastVersion {
-		return fmt.Errorf("Must upgrade from db version %d (concourse 3.6.0), current db version: %d", oldMigrationLastVersion, dbVersion)
+	if !isRegisteredDriver(self.driver) {
+		return fmt.Errorf("unknown database driver %q (registered drivers: %s)", self.driver, strings.Join(sql.Drivers(), ", "))
 	}
 
-	if _, err = db.Exec("DROP TABLE IF EXISTS migration_version"); err != nil {
-		return err
+	maintenanceDatabase := self.MaintenanceDatabase
+	if maintenanceDatabase == "" {
+		maintenanceDatabase = "postgres"
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version bigint, dirty boolean)")
+	name, maintenanceDataSourceName, err := maintenanceDataSource(self.dataSourceName, maintenanceDatabase)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", newMigrationStartVersion)
+	db, err := sql.Open(self.driver, maintenanceDataSourceName)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	defer db.Close()
 
-type Migrator interface {
-	CurrentVersion() (int, error)
-	SupportedVersion() (int, error)
-	Migrate(version int) error
-	Up() error
-	Migrations() ([]migration, error)
-}
+	var exists int
+	err = db.QueryRow("SELECT 1 FROM pg_database WHERE datname = $1", name).Scan(&exists)
+	if err == nil {
+		return nil
+	}
 
-func NewMigrator(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy) Migrator {
-	return NewMigratorForMigrations(db, lockFactory, strategy, &packrSource{packr.NewBox("./migrations")})
-}
+	if err != sql.ErrNoRows {
+		return err
+	}
 
-func NewMigratorForMigrations(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy, bindata Bindata) Migrator {
-	return &migrator{
-		db,
-		lockFactory,
-		strategy,
-		lager.NewLogger("migrations"),
-		bindata,
+	_, err = db.Exec("CREATE DATABASE " + pq.QuoteIdentifier(name))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P04" {
+		// created by another instance since the check
+		return nil
 	}
-}
 
-type migrator struct {
-	db          *sql.DB
-	lockFactory lock.LockFactory
-	strategy    encryption.Strategy
-	logger      lager.Logger
-	bindata     Bindata
+	return err
 }
 
-func (m *migrator) SupportedVersion() (int, error) {
-	matches := []migration{}
+var dataSourceDBName = regexp.MustCompile(`(^|\s)dbname\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
 
-	assets := m.bindata.AssetNames()
+// maintenanceDataSource returns the database named by a data source name, in
+// either the URL or the key=value form accepted by lib/pq, along with the
+// data source name of maintenanceDatabase on the same server.
+func maintenanceDataSource(dataSourceName string, maintenanceDatabase string) (string, string, error) {
+	if strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://") {
+		u, err := url.Parse(dataSourceName)
+		if err != nil {
+			return "", "", err
+		}
 
-	var parser = NewParser(m.bindata)
-	for _, match := range assets {
-		if migration, err := parser.ParseMigrationFilename(match); err == nil {
-			matches = append(matches, migration)
+		name := strings.TrimPrefix(u.Path, "/")
+		if name == "" {
+			return "", "", errors.New("no database name in data source name")
 		}
+
+		u.Path = "/" + maintenanceDatabase
+		u.RawPath = ""
+
+		return name, u.String(), nil
+	}
+
+	match := dataSourceDBName.FindStringSubmatchIndex(dataSourceName)
+	if match == nil {
+		return "", "", errors.New("no database name in data source name")
+	}
+
+	name := dataSourceName[match[4]:match[5]]
+	if strings.HasPrefix(name, "'") {
+		name = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(name[1 : len(name)-1])
 	}
-	sortMigrations(matches)
-	return matches[len(matches)-1].Version, nil
+
+	quoted := "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(maintenanceDatabase) + "'"
+
+	return name, dataSourceName[:match[4]] + quoted + dataSourceName[match[5]:], nil
 }
 
-func (self *migrator) CurrentVersion() (int, error) {
-	var currentVersion int
-	var direction string
-	err := self.db.QueryRow("SELECT version, direction FROM migrations_history WHERE status!='failed' ORDER BY tstamp DESC LIMIT 1").Scan(&currentVersion, &direction)
+func (self *OpenHelper) CurrentVersion() (int, error) {
+	db, err := self.openDB()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil
-		}
 		return -1, err
 	}
-	migrations, err := self.Migrations()
+
+	defer self.closeDB(db)
+
+	return NewMigrator(db, self.lockFactory, self.strategy, self.migratorOptions()...).CurrentVersion()
+}
+
+func (self *OpenHelper) SupportedVersion() (int, error) {
+	db, err := self.openDB()
 	if err != nil {
 		return -1, err
 	}
-	versions := []int{migrations[0].Version}
-	for _, m := range migrations {
-		if m.Version > versions[len(versions)-1] {
-			versions = append(versions, m.Version)
-		}
-	}
-	for i, version := range versions {
-		if currentVersion == version && direction == "down" {
-			currentVersion = versions[i-1]
-			break
-		}
-	}
-	return currentVersion, nil
-}
 
-func (self *migrator) Migrate(toVersion int) error {
+	defer self.closeDB(db)
 
-	lock, err := self.acquireLock()
+	return NewMigrator(db, self.lockFactory, self.strategy, self.migratorOptions()...).SupportedVersion()
+}
+
+func (self *OpenHelper) Open() (*sql.DB, error) {
+	db, err := self.openDB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if lock != nil {
-		defer lock.Release()
+	m := newMigrator(db, self.lockFactory, self.strategy, newMigrationsSource(), self.migratorOptions()...)
+
+	if version, err := m.SupportedVersion(); err == nil {
+		if err := self.checkDowngrade(m, version); err != nil {
+			_ = self.closeDB(db)
+			return nil, err
+		}
 	}
 
-	existingDBVersion, err := self.migrateFromSchemaMigrations()
-	if err != nil {
-		return err
+	if err := m.Up(); err != nil && err != ErrNoChange {
+		_ = self.closeDB(db)
+		return nil, err
 	}
 
-	_, err = self.db.Exec("CREATE TABLE IF NOT EXISTS migrations_history (version bigint, tstamp timestamp with time zone, direction varchar, status varchar, dirty boolean)")
+	return db, nil
+}
+
+func (self *OpenHelper) OpenAtVersion(version int) (*sql.DB, error) {
+	db, err := self.openDB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if existingDBVersion > 0 {
-		var containsOldMigrationInfo bool
-		err = self.db.QueryRow("SELECT EXISTS (SELECT 1 FROM migrations_history where version=$1)", existingDBVersion).Scan(&containsOldMigrationInfo)
+	m := newMigrator(db, self.lockFactory, self.strategy, newMigrationsSource(), self.migratorOptions()...)
 
-		if !containsOldMigrationInfo {
-			_, err = self.db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, 'up', 'passed', false)", existingDBVersion)
-			if err != nil {
-				return err
-			}
-		}
+	if err := self.checkDowngrade(m, version); err != nil {
+		_ = self.closeDB(db)
+		return nil, err
 	}
 
-	currentVersion, err := self.CurrentVersion()
-	if err != nil {
-		return err
+	if err := m.Migrate(version); err != nil && err != ErrNoChange {
+		_ = self.closeDB(db)
+		return nil, err
 	}
 
-	migrations, err := self.Migrations()
+	return db, nil
+}
+
+func (self *OpenHelper) checkDowngrade(m *migrator, version int) error {
+	if self.AllowDowngrade {
+		return nil
+	}
+
+	currentVersion, err := m.versionBeforeMigrating()
 	if err != nil {
 		return err
 	}
 
-	if currentVersion <= toVersion {
-		for _, m := range migrations {
-			if currentVersion < m.Version && m.Version <= toVersion && m.Direction == "up" {
-				err = self.runMigration(m)
-				if err != nil {
-					return err
-				}
-			}
-		}
-	} else {
-		for i := len(migrations) - 1; i >= 0; i-- {
-			if currentVersion >= migrations[i].Version && migrations[i].Version > toVersion && migrations[i].Direction == "down" {
-				err = self.runMigration(migrations[i])
-				if err != nil {
-					return err
-				}
-
-			}
-		}
-
-		err = self.migrateToSchemaMigrations(toVersion)
-		if err != nil {
-			return err
-		}
+	if currentVersion > version {
+		return &DowngradeError{CurrentVersion: currentVersion, TargetVersion: version}
 	}
+
 	return nil
 }
 
-type Strategy int
+func (self *OpenHelper) ForceUnlock() error {
+	db, err := self.openDB()
+	if err != nil {
+		return err
+	}
 
-const (
-	GoMigration Strategy = iota
-	SQLTransaction
-	SQLNoTransaction
-)
+	defer self.closeDB(db)
 
-type migration struct {
-	Name       string
-	Version    int
-	Direction  string
-	Statements []string
-	Strategy   Strategy
+	return NewMigrator(db, self.lockFactory, self.strategy, self.migratorOptions()...).ForceUnlock()
 }
 
-func (m *migrator) recordMigrationFailure(migration migration, err error, dirty bool) error {
-	_, dbErr := m.db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, $2, 'failed', $3)", migration.Version, migration.Direction, dirty)
-	return multierror.Append(fmt.Errorf("Migration '%s' failed: %v", migration.Name, err), dbErr)
+func (self *OpenHelper) MigrateToVersion(version int) error {
+	_, err := self.MigrateToVersionWithResult(version)
+	return err
 }
 
-func (m *migrator) runMigration(migration migration) error {
-	var err error
+func (self *OpenHelper) MigrateToVersionWithResult(version int) (MigrateResult, error) {
+	var result MigrateResult
 
-	switch migration.Strategy {
-	case GoMigration:
-		err = migrations.NewMigrations(m.db, m.strategy).Run(migration.Name)
-		if err != nil {
-			return m.recordMigrationFailure(migration, err, false)
-		}
-	case SQLTransaction:
-		tx, err := m.db.Begin()
-		for _, statement := range migration.Statements {
-			_, err = tx.Exec(statement)
-			if err != nil {
-				tx.Rollback()
-				err = multierror.Append(fmt.Errorf("Transaction %v failed, rolled back the migration", statement), err)
-				if err != nil {
-					return m.recordMigrationFailure(migration, err, false)
-				}
-			}
-		}
-		err = tx.Commit()
-	case SQLNoTransaction:
-		_, err = m.db.Exec(migration.Statements[0])
-		if err != nil {
-			return m.recordMigrationFailure(migration, err, true)
-		}
+	db, err := self.openDB()
+	if err != nil {
+		return result, err
 	}
 
-	_, err = m.db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, $2, 'passed', false)", migration.Version, migration.Direction)
-	return err
-}
+	defer self.closeDB(db)
+	m := newMigrator(db, self.lockFactory, self.strategy, newMigrationsSource(), self.migratorOptions()...)
 
-func (self *migrator) Migrations() ([]migration, error) {
-	migrationList := []migration{}
-	assets := self.bindata.AssetNames()
-	var parser = NewParser(self.bindata)
-	for _, assetName := range assets {
-		parsedMigration, err := parser.ParseFileToMigration(assetName)
+	var legacy LegacyCheckResult
+	if m.dialect.HasLegacyTables() {
+		legacy, err = self.migrateFromMigrationVersion(m)
 		if err != nil {
-			return nil, err
+			return result, err
 		}
-		migrationList = append(migrationList, parsedMigration)
 	}
 
-	sortMigrations(migrationList)
+	result, err = m.migrate(context.Background(), version, nil)
+	result.UpgradedFromLegacy = legacy.Transitioned
 
-	return migrationList, nil
+	return result, err
 }
 
-func (self *migrator) Up() error {
-	migrations, err := self.Migrations()
+const (
+	// oldMigrationLastVersion is the last version of the legacy migrator,
+	// shipped with Concourse 3.6.0.
+	oldMigrationLastVersion = 189
+
+	// newMigrationStartVersion is the version the legacy schema corresponds
+	// to in the current migrator.
+	newMigrationStartVersion = 1510262030
+)
+
+// LegacyTransition describes what migrating would do about the
+// migration_version table of the migrator used up to Concourse 3.6.0.
+type LegacyTransition struct {
+	// TableExists is set when the database has a migration_version table.
+	TableExists bool
+
+	// Version is the version recorded in migration_version, if it exists.
+	Version int
+
+	// Upgradable is set when Version is the one of Concourse 3.6.0, the only
+	// version that can be upgraded from.
+	Upgradable bool
+
+	// Plan describes what migrating would do.
+	Plan string
+}
+
+// PeekLegacyTransition reports what migrating would do about a legacy
+// migration_version table, without changing the database, so that the
+// one-time upgrade from Concourse 3.6.0 can be checked beforehand.
+func (self *OpenHelper) PeekLegacyTransition() (LegacyTransition, error) {
+	var transition LegacyTransition
+
+	db, err := self.openDB()
 	if err != nil {
-		return err
+		return transition, err
 	}
-	return self.Migrate(migrations[len(migrations)-1].Version)
-}
 
-func (self *migrator) acquireLock() (lock.Lock, error) {
+	defer self.closeDB(db)
 
-	var err error
-	var acquired bool
-	var newLock lock.Lock
+	m := newMigrator(db, self.lockFactory, self.strategy, newMigrationsSource(), self.migratorOptions()...)
 
-	if self.lockFactory != nil {
-		for {
-			newLock, acquired, err = self.lockFactory.Acquire(self.logger, lock.NewDatabaseMigrationLockID())
+	if !m.dialect.HasLegacyTables() || !m.versionTableExists("migration_version") {
+		transition.Plan = "no legacy migration_version table, migrations run as usual"
+		return transition, nil
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	transition.TableExists = true
 
-			if acquired {
-				break
-			}
+	err = db.QueryRow("SELECT version FROM " + m.versionTable("migration_version")).Scan(&transition.Version)
+	if err != nil {
+		return transition, err
+	}
 
-			time.Sleep(1 * time.Second)
-		}
+	if transition.Version != oldMigrationLastVersion {
+		transition.Plan = fmt.Sprintf("refuse to migrate, must upgrade from db version %d (concourse 3.6.0)", oldMigrationLastVersion)
+		return transition, nil
 	}
 
-	return newLock, err
+	transition.Upgradable = true
+	transition.Plan = fmt.Sprintf("drop migration_version and record version %d in schema_migrations", newMigrationStartVersion)
+
+	return transition, nil
 }
 
-func checkTableExist(db *sql.DB, tableName string) bool {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_name=$1)", tableName).Scan(&exists)
-	return err != nil || exists
+// LegacyCheckResult describes what was found, and done, about the legacy
+// migration_version table before migrating.
+type LegacyCheckResult struct {
+	// Present is set when the database had a migration_version table.
+	Present bool
+
+	// Transitioned is set when migration_version was at the version of
+	// Concourse 3.6.0 and has been replaced by schema_migrations, recording
+	// StartVersion.
+	Transitioned bool
+	StartVersion int
 }
 
-func (self *migrator) migrateFromSchemaMigrations() (int, error) {
-	if !checkTableExist(self.db, "schema_migrations") || checkTableExist(self.db, "migrations_history") {
-		return 0, nil
+// migrateFromMigrationVersion replaces a legacy migration_version table at the
+// version of Concourse 3.6.0 with a schema_migrations table at the
+// corresponding version of the current migrator, and fails for any other
+// version, which cannot be upgraded from.
+func (self *OpenHelper) migrateFromMigrationVersion(m *migrator) (LegacyCheckResult, error) {
+	var result LegacyCheckResult
+
+	if !m.versionTableExists("migration_version") {
+		return result, nil
 	}
 
-	var isDirty = false
-	var existingVersion int
-	err := self.db.QueryRow("SELECT dirty, version FROM schema_migrations LIMIT 1").Scan(&isDirty, &existingVersion)
+	result.Present = true
+
+	var dbVersion int
+	err := m.db.QueryRow("SELECT version FROM " + m.versionTable("migration_version")).Scan(&dbVersion)
 	if err != nil {
-		return 0, err
+		return result, err
 	}
 
-	if isDirty {
-		return 0, errors.New("cannot begin migration. Database is in a dirty state")
+	if dbVersion != oldMigrationLastVersion {
+		return result, fmt.Errorf("Must upgrade from db version %d (concourse 3.6.0), current db version: %d", oldMigrationLastVersion, dbVersion)
+	}
+
+	m.logger.Info("migrating-from-legacy-schema", Data{
+		"detected":         "legacy Concourse 3.6.0 schema",
+		"legacy-version":   oldMigrationLastVersion,
+		"starting-version": newMigrationStartVersion,
+	})
+
+	// in one transaction, so that dying part way cannot leave an empty
+	// schema_migrations table behind
+	tx, err := m.db.Begin()
+	if err != nil {
+		return result, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DROP TABLE IF EXISTS " + m.versionTable("migration_version"))
+	if err != nil {
+		return result, err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS " + m.versionTable("schema_migrations") + " (version bigint, dirty boolean)")
+	if err != nil {
+		return result, err
+	}
+
+	_, err = tx.Exec("INSERT INTO "+m.versionTable("schema_migrations")+" (version, dirty) VALUES ($1, false)", newMigrationStartVersion)
+	if err != nil {
+		return result, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+
+	result.Transitioned = true
+	result.StartVersion = newMigrationStartVersion
+
+	return result, nil
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+const (
+	initialPingBackoff = 100 * time.Millisecond
+	maxPingBackoff     = 5 * time.Second
+)
+
+func waitForDatabase(ctx context.Context, db pinger, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	backoff := initialPingBackoff
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if timeout == 0 {
+				return fmt.Errorf("stopped waiting for database: %v", err)
+			}
+
+			return fmt.Errorf("timed out waiting for database after %s: %v", timeout, err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxPingBackoff {
+			backoff = maxPingBackoff
+		}
+	}
+}
+
+type Migrator interface {
+	CurrentVersion() (int, error)
+	CurrentVersionContext(ctx context.Context, db *sql.DB) (int, error)
+	CurrentVersionName() (int, string, error)
+	CurrentVersionDirty() (int, bool, error)
+	SupportedVersion() (int, error)
+	SupportedVersions() []int
+	MigrationFilesFor(direction string) []string
+	MigrationSetChecksum() (string, error)
+	Migrate(version int) error
+	MigrateContext(ctx context.Context, version int) error
+	StartAsync(version int) (*MigrationHandle, error)
+	Up() error
+	UpToSupported() error
+	UpWithProgress(progress func(done, total int)) error
+	UpOne() error
+	DownOne() error
+	UpToLatestMinus(n int) error
+	Repair(knownGood int) error
+	Timings(version int) ([]TimingRecord, error)
+	ExportVersionTable() ([]byte, error)
+	Baseline(version int) error
+	IsFreshDatabase() (bool, error)
+	Reconcile() (ReconcileReport, error)
+	Migrations() ([]migration, error)
+	CompactHistory(keep int) error
+	Healthcheck() (HealthReport, error)
+	ForceUnlock() error
+	AcquireLock(ctx context.Context) (lock.Lock, error)
+	Verify() error
+	IsMigrating() (bool, error)
+	Plan(version int) ([]PlannedMigration, error)
+	DownPlan(version int) ([]PlannedMigration, error)
+	RoundTripCheck() error
+	CheckInvariants() error
+}
+
+func NewMigrator(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy, opts ...MigratorOption) Migrator {
+	return NewMigratorForMigrations(db, lockFactory, strategy, newMigrationsSource(), opts...)
+}
+
+func newMigrationsSource() Bindata {
+	return &packrSource{packr.NewBox("./migrations")}
+}
+
+func NewMigratorForMigrations(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy, bindata Bindata, opts ...MigratorOption) Migrator {
+	return newMigrator(db, lockFactory, strategy, bindata, opts...)
+}
+
+func newMigrator(db *sql.DB, lockFactory lock.LockFactory, strategy encryption.Strategy, bindata Bindata, opts ...MigratorOption) *migrator {
+	m := &migrator{
+		db:          db,
+		lockFactory: lockFactory,
+		strategy:    strategy,
+		logger:      NewLagerLogger(lager.NewLogger("migrations")),
+		bindata:     bindata,
+		dialect:     postgresDialect{},
+
+		lockPollInterval:      time.Second,
+		lockHeartbeatInterval: 10 * time.Second,
+		lockErrorTimeout:      30 * time.Second,
+
+		errorClassifier:  NewPostgresErrorClassifier(),
+		setNoticeHandler: setPQNoticeHandler,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	// migrations of different schemas are independent, so they need not wait
+	// on each other unless a lock was chosen explicitly
+	if m.lockID == nil {
+		if m.schema != "" {
+			m.lockID = lock.NewNamedDatabaseMigrationLockID(m.schema)
+		} else {
+			m.lockID = lock.NewDatabaseMigrationLockID()
+		}
+	}
+
+	// the assets are fixed at build time, so the versions they provide only
+	// need to be parsed once
+	m.supportedVersions, m.assets = m.parseAssets()
+
+	return m
+}
+
+type migrator struct {
+	db          *sql.DB
+	lockFactory lock.LockFactory
+	lockID      lock.LockID
+	strategy    encryption.Strategy
+	logger      Logger
+	bindata     Bindata
+	dialect     Dialect
+
+	lockPollInterval      time.Duration
+	lockHeartbeatInterval time.Duration
+	lockErrorTimeout      time.Duration
+
+	templateData  map[string]string
+	stripComments bool
+	noTxSentinel  *regexp.Regexp
+	configErr     error
+	atomicRun     bool
+
+	statementTransform  func(string) (string, error)
+	isolationLevel      sql.IsolationLevel
+	connPerMigration    bool
+	logNotices          bool
+	setNoticeHandler    func(driver.Conn, func(*pq.Error)) error
+	txMigrations        map[txMigrationKey]TxMigration
+	checkOwnership      bool
+	stopAfterCurrent    <-chan struct{}
+	skipExistingIndexes bool
+	noTracking          bool
+	statementProgress   bool
+	verbosePlan         bool
+	errorClassifier     ErrorClassifier
+	allowEmpty          bool
+	logQueries          bool
+	redactPatterns      []*regexp.Regexp
+	requireDownFiles    bool
+	minSupportedVersion int
+	postMigrateAnalyze  bool
+	schema              string
+	onRetry             func(version, statementIndex, attempt int, err error)
+	autoResumeDirty     bool
+	environment         string
+
+	asyncMutex   sync.Mutex
+	asyncRunning bool
+
+	supportedVersions []int
+	assets            map[int]versionAssets
+}
+
+func (m *migrator) newParser() *Parser {
+	parser := NewParser(m.bindata)
+	parser.templateData = m.templateData
+	parser.stripComments = m.stripComments
+	parser.noTxSentinel = m.noTxSentinel
+	return parser
+}
+
+func (m *migrator) SupportedVersion() (int, error) {
+	if len(m.supportedVersions) == 0 {
+		return -1, ErrNoMigrations
+	}
+
+	return m.supportedVersions[len(m.supportedVersions)-1], nil
+}
+
+func (m *migrator) SupportedVersions() []int {
+	versions := make([]int, len(m.supportedVersions))
+	copy(versions, m.supportedVersions)
+	return versions
+}
+
+// MigrationSetChecksum returns a hex-encoded SHA-256 of the names and raw
+// contents of every migration asset, in name order. It only changes when the
+// set of migrations does, so it can key caches of provisioned schemas.
+func (m *migrator) MigrationSetChecksum() (string, error) {
+	names := append([]string{}, m.bindata.AssetNames()...)
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		contents, err := m.bindata.Asset(name)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(hash, "%d:%s%d:", len(name), name, len(contents))
+		hash.Write(contents)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// parseAssets returns the versions of the migrations, in ascending order, and
+// the files that migrate up to and down from each.
+func (m *migrator) parseAssets() ([]int, map[int]versionAssets) {
+	matches := []migration{}
+
+	assets := append([]string{}, m.bindata.AssetNames()...)
+	sort.Strings(assets)
+
+	var parser = m.newParser()
+	for _, match := range assets {
+		if migration, err := parser.ParseMigrationFilename(match); err == nil {
+			matches = append(matches, migration)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Version < matches[j].Version
+	})
+
+	versions := []int{}
+	byVersion := map[int]versionAssets{}
+	for _, match := range matches {
+		if len(versions) == 0 || versions[len(versions)-1] != match.Version {
+			versions = append(versions, match.Version)
+		}
+
+		files := byVersion[match.Version]
+		switch {
+		case match.Direction == "up" && files.up == "":
+			files.up = match.Filename
+		case match.Direction == "down" && files.down == "":
+			files.down = match.Filename
+		}
+		byVersion[match.Version] = files
+	}
+	return versions, byVersion
+}
+
+func (self *migrator) CurrentVersion() (int, error) {
+	return self.CurrentVersionContext(context.Background(), self.db)
+}
+
+// CurrentVersionContext reads the current version through the given
+// connection rather than the migrator's own, e.g. one pointed at a read-only
+// replica. It only ever reads from the database.
+func (self *migrator) CurrentVersionContext(ctx context.Context, db *sql.DB) (int, error) {
+	var currentVersion int
+	var direction string
+	err := db.QueryRowContext(ctx, self.dialect.CurrentVersionQuery(self.versionTable("migrations_history"))).Scan(&currentVersion, &direction)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return -1, err
+	}
+	return self.versionAfter(currentVersion, direction), nil
+}
+
+// versionAfter returns the version the database is at after the latest
+// migration recorded, of version in direction, which for a down migration is
+// the version before it.
+func (self *migrator) versionAfter(version int, direction string) int {
+	for i, supported := range self.supportedVersions {
+		if version == supported && direction == "down" {
+			if i == 0 {
+				return 0
+			}
+			return self.supportedVersions[i-1]
+		}
+	}
+	return version
+}
+
+// CurrentVersionDirty reads the current version along with whether the latest
+// migration attempted left the database dirty, in a single query, for
+// readiness checks that run often.
+func (self *migrator) CurrentVersionDirty() (int, bool, error) {
+	var (
+		version   sql.NullInt64
+		direction sql.NullString
+		dirty     bool
+	)
+	err := self.db.QueryRow(self.currentVersionDirtyQuery()).Scan(&version, &direction, &dirty)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return -1, false, err
+	}
+
+	if !version.Valid {
+		return 0, dirty, nil
+	}
+
+	return self.versionAfter(int(version.Int64), direction.String), dirty, nil
+}
+
+// currentVersionDirtyQuery joins the dirty flag of the latest row of
+// migrations_history onto the current version, which comes from the latest
+// row that did not fail and may be missing.
+func (self *migrator) currentVersionDirtyQuery() string {
+	table := self.versionTable("migrations_history")
+
+	return "SELECT applied.version, applied.direction, latest.dirty FROM (SELECT dirty FROM " + table + " ORDER BY " + self.dialect.LatestFirst() + " LIMIT 1) latest LEFT JOIN (" + self.dialect.CurrentVersionQuery(table) + ") applied ON 1=1"
+}
+
+// CurrentVersionName returns the current version along with the name of its
+// migration, e.g. "add_pipelines" for 1520000000_add_pipelines.up.sql. The
+// name is empty at version 0 or if the version has no migration file.
+func (self *migrator) CurrentVersionName() (int, string, error) {
+	version, err := self.CurrentVersion()
+	if err != nil {
+		return version, "", err
+	}
+
+	filename, found := self.upAsset(version)
+	if !found {
+		return version, "", nil
+	}
+
+	return version, migrationName(filename), nil
+}
+
+type HealthReport struct {
+	CurrentVersion   int       `json:"current_version"`
+	SupportedVersion int       `json:"supported_version"`
+	Pending          bool      `json:"pending"`
+	Dirty            bool      `json:"dirty"`
+	CheckedAt        time.Time `json:"checked_at"`
+}
+
+// Healthcheck reports the state of the schema without taking the migration
+// lock, so it is safe to call while another process is migrating.
+func (self *migrator) Healthcheck() (HealthReport, error) {
+	report := HealthReport{
+		CheckedAt: time.Now(),
+	}
+
+	var err error
+	report.SupportedVersion, err = self.SupportedVersion()
+	if err != nil {
+		return HealthReport{}, err
+	}
+
+	if self.versionTableExists("migrations_history") {
+		report.CurrentVersion, report.Dirty, err = self.CurrentVersionDirty()
+		if err != nil {
+			return HealthReport{}, err
+		}
+	}
+
+	report.Pending = report.CurrentVersion < report.SupportedVersion
+
+	return report, nil
+}
+
+func (self *migrator) Migrate(toVersion int) error {
+	return self.MigrateContext(context.Background(), toVersion)
+}
+
+// MigrateContext is Migrate, stopping once ctx is done. A transactional
+// migration in progress is rolled back and ctx.Err() is returned.
+func (self *migrator) MigrateContext(ctx context.Context, toVersion int) error {
+	result, err := self.migrate(ctx, toVersion, nil)
+	if err != nil {
+		return err
+	}
+
+	if result.unchanged() {
+		return ErrNoChange
+	}
+
+	return nil
+}
+
+// migrate migrates to toVersion, calling progress, if given, after each
+// migration file is applied.
+func (self *migrator) migrate(ctx context.Context, toVersion int, progress func(done, total int)) (MigrateResult, error) {
+	var result MigrateResult
+
+	if self.configErr != nil {
+		return result, self.configErr
+	}
+
+	if len(self.supportedVersions) == 0 && !self.allowEmpty {
+		return result, ErrNoMigrations
+	}
+
+	err := self.checkDownFiles()
+	if err != nil {
+		return result, err
+	}
+
+	err = self.checkNoticeLogging(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	lock, err := self.acquireLock()
+	if err != nil {
+		return result, err
+	}
+
+	if lock != nil {
+		defer lock.Release()
+	}
+
+	return self.migrateLocked(ctx, toVersion, progress)
+}
+
+// migrateLocked migrates to toVersion like migrate, with the migration lock
+// already held by the caller.
+func (self *migrator) migrateLocked(ctx context.Context, toVersion int, progress func(done, total int)) (MigrateResult, error) {
+	var result MigrateResult
+
+	if self.checkOwnership {
+		self.warnIfNotOwner()
+	}
+
+	if self.noTracking {
+		return self.migrateUntracked(ctx, toVersion, progress)
+	}
+
+	existingDBVersion, dirtyLegacyVersion, err := self.migrateFromSchemaMigrations()
+	if err != nil {
+		return result, err
+	}
+
+	// the plan is worked out and logged before anything is written, from
+	// the version carried over from schema_migrations unless one is recorded
+	currentVersion := existingDBVersion
+
+	recorded, err := self.historyRecorded()
+	if err != nil {
+		return result, err
+	}
+
+	if recorded {
+		currentVersion, err = self.CurrentVersion()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	migrations, err := self.Migrations()
+	if err != nil {
+		return result, err
+	}
+
+	result.FromVersion = currentVersion
+	result.ToVersion = currentVersion
+
+	selected, direction, err := self.migrationsBetween(currentVersion, toVersion, migrations)
+	result.Direction = direction
+	if err != nil {
+		return result, err
+	}
+
+	self.logPlan(direction, currentVersion, toVersion, selected)
+
+	_, err = self.db.Exec(self.dialect.CreateVersionTable(self.versionTable("migrations_history")))
+	if err != nil {
+		return result, err
+	}
+
+	_, err = self.db.Exec(self.dialect.CreateTimingsTable(self.versionTable("migration_timings")))
+	if err != nil {
+		return result, err
+	}
+
+	_, err = self.db.Exec(self.dialect.CreateProgressTable(self.versionTable("migration_progress")))
+	if err != nil {
+		return result, err
+	}
+
+	recovering, err := self.markMigrating()
+	if err != nil {
+		return result, err
+	}
+
+	defer self.clearMigrating()
+
+	run := runState{
+		recovering:         recovering,
+		dirtyLegacyVersion: dirtyLegacyVersion,
+	}
+
+	if run.recovering {
+		self.logger.Info("recovering-interrupted-run")
+	}
+
+	if existingDBVersion > 0 {
+		var containsOldMigrationInfo bool
+		err = self.db.QueryRow("SELECT EXISTS (SELECT 1 FROM "+self.versionTable("migrations_history")+" where version=$1)", existingDBVersion).Scan(&containsOldMigrationInfo)
+
+		if !containsOldMigrationInfo {
+			_, err = self.db.Exec("INSERT INTO "+self.versionTable("migrations_history")+" (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, 'up', 'passed', false)", existingDBVersion)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if direction == "up" {
+		for _, m := range selected {
+			if self.stopRequested() {
+				self.logger.Info("stopped-early", Data{"version": m.Version, "target": toVersion})
+				return result, &StoppedEarlyError{LastAppliedVersion: result.ToVersion, TargetVersion: toVersion}
+			}
+
+			err = self.runMigration(ctx, m, run)
+			if err != nil {
+				if self.atomicRun {
+					return result, self.rollbackFailedRun(currentVersion, m, migrations, run, err)
+				}
+				return result, err
+			}
+
+			result.Applied = append(result.Applied, m.Filename)
+			result.AppliedVersions = append(result.AppliedVersions, m.Version)
+			result.ToVersion = m.Version
+			reportProgress(progress, len(result.Applied), len(selected))
+		}
+	} else {
+		for _, m := range selected {
+			err = self.runMigration(ctx, m, run)
+			if err != nil {
+				return result, err
+			}
+
+			result.Applied = append(result.Applied, m.Filename)
+			result.AppliedVersions = append(result.AppliedVersions, m.Version)
+			reportProgress(progress, len(result.Applied), len(selected))
+		}
+
+		err = self.migrateToSchemaMigrations(toVersion)
+		if err != nil {
+			return result, err
+		}
+
+		result.ToVersion, err = self.CurrentVersion()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// migrateUntracked runs every up migration up to toVersion, assuming an
+// empty database, without reading or recording any version.
+func (self *migrator) migrateUntracked(ctx context.Context, toVersion int, progress func(done, total int)) (MigrateResult, error) {
+	result := MigrateResult{Direction: "up"}
+
+	migrations, err := self.Migrations()
+	if err != nil {
+		return result, err
+	}
+
+	selected := self.upMigrations(0, toVersion, migrations)
+	self.logPlan("up", 0, toVersion, selected)
+
+	for _, m := range selected {
+		err = self.runMigration(ctx, m, runState{})
+		if err != nil {
+			return result, err
+		}
+
+		result.Applied = append(result.Applied, m.Filename)
+		result.AppliedVersions = append(result.AppliedVersions, m.Version)
+		result.ToVersion = m.Version
+		reportProgress(progress, len(result.Applied), len(selected))
+	}
+
+	return result, nil
+}
+
+// logPlan logs every migration file about to run, in order, when
+// WithVerbosePlan is set.
+func (self *migrator) logPlan(direction string, fromVersion int, toVersion int, selected []migration) {
+	if !self.verbosePlan {
+		return
+	}
+
+	files := make([]string, len(selected))
+	for i, m := range selected {
+		files[i] = m.Filename
+	}
+
+	self.logger.Info("about-to-apply", Data{"direction": direction, "from": fromVersion, "to": toVersion, "migrations": files})
+}
+
+func reportProgress(progress func(done, total int), done int, total int) {
+	if progress != nil {
+		progress(done, total)
+	}
+}
+
+func (self *migrator) stopRequested() bool {
+	select {
+	case <-self.stopAfterCurrent:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *migrator) runDownMigrations(ctx context.Context, currentVersion int, toVersion int, migrations []migration, run runState) error {
+	selected, err := self.downMigrations(currentVersion, toVersion, migrations)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range selected {
+		err = self.runMigration(ctx, m, run)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrationsBetween returns the migrations that take the database from
+// currentVersion to toVersion, in the order they run, and whether they go
+// "up" or "down". Nothing needs to run when the versions are equal, which
+// counts as up.
+func (self *migrator) migrationsBetween(currentVersion int, toVersion int, migrations []migration) ([]migration, string, error) {
+	if currentVersion <= toVersion {
+		return self.upMigrations(currentVersion, toVersion, migrations), "up", nil
+	}
+
+	selected, err := self.downMigrations(currentVersion, toVersion, migrations)
+	if err != nil {
+		return nil, "down", err
+	}
+
+	return selected, "down", nil
+}
+
+// upMigrations returns the up migrations that take the database from
+// currentVersion to toVersion, in the order they run.
+func (self *migrator) upMigrations(currentVersion int, toVersion int, migrations []migration) []migration {
+	byFilename := migrationsByFilename(migrations)
+
+	selected := []migration{}
+	for _, version := range self.supportedVersions {
+		if currentVersion < version && version <= toVersion {
+			if filename, found := self.upAsset(version); found {
+				selected = append(selected, byFilename[filename])
+			}
+		}
+	}
+
+	return selected
+}
+
+// downMigrations returns the down migrations that take the database from
+// currentVersion back to toVersion, in the order they run. If any version in
+// between has no down migration, none are returned and the error is an
+// *IrreversibleMigrationError listing every such version, so that a
+// rollback never starts only to get stuck part way.
+func (self *migrator) downMigrations(currentVersion int, toVersion int, migrations []migration) ([]migration, error) {
+	byFilename := migrationsByFilename(migrations)
+
+	selected := []migration{}
+	missing := []int{}
+	for i := len(self.supportedVersions) - 1; i >= 0; i-- {
+		version := self.supportedVersions[i]
+		if currentVersion >= version && version > toVersion {
+			filename, found := self.downAsset(version)
+			if !found {
+				missing = append(missing, version)
+				continue
+			}
+
+			selected = append(selected, byFilename[filename])
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, &IrreversibleMigrationError{Versions: missing, TargetVersion: toVersion}
+	}
+
+	return selected, nil
+}
+
+// checkDownFiles returns an error naming every version without a down
+// migration when WithRequireDownFiles is set.
+func (self *migrator) checkDownFiles() error {
+	if !self.requireDownFiles {
+		return nil
+	}
+
+	var missing []string
+	for _, version := range self.supportedVersions {
+		if _, found := self.downAsset(version); !found {
+			missing = append(missing, strconv.Itoa(version))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing down migrations for versions: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func migrationsByFilename(migrations []migration) map[string]migration {
+	byFilename := map[string]migration{}
+	for _, m := range migrations {
+		byFilename[m.Filename] = m
+	}
+
+	return byFilename
+}
+
+// MigrationFilesFor returns the names of the migration files of the given
+// direction, "up" or "down", in ascending order of version. It is empty for
+// any other direction.
+func (self *migrator) MigrationFilesFor(direction string) []string {
+	files := []string{}
+	for _, version := range self.supportedVersions {
+		var (
+			filename string
+			found    bool
+		)
+
+		switch direction {
+		case "up":
+			filename, found = self.upAsset(version)
+		case "down":
+			filename, found = self.downAsset(version)
+		}
+
+		if found {
+			files = append(files, filename)
+		}
+	}
+
+	return files
+}
+
+// versionAssets are the names of the up and down migration files of a
+// version; either may be empty.
+type versionAssets struct {
+	up   string
+	down string
+}
+
+// upAsset returns the name of the file that migrates up to version.
+func (self *migrator) upAsset(version int) (string, bool) {
+	assets := self.assets[version]
+	return assets.up, assets.up != ""
+}
+
+// downAsset returns the name of the file that reverts version.
+func (self *migrator) downAsset(version int) (string, bool) {
+	assets := self.assets[version]
+	return assets.down, assets.down != ""
+}
+
+type PlannedMigration struct {
+	Version    int
+	Direction  string
+	Filename   string
+	Statements []Statement
+}
+
+// versionBeforeMigrating reads the current version without creating or
+// updating any version tables, falling back to the legacy schema_migrations
+// table before the first run of this migrator.
+func (self *migrator) versionBeforeMigrating() (int, error) {
+	recorded, err := self.historyRecorded()
+	if err != nil {
+		return 0, err
+	}
+
+	if recorded {
+		return self.CurrentVersion()
+	}
+
+	version, _, err := self.migrateFromSchemaMigrations()
+	return version, err
+}
+
+// historyRecorded reports whether migrations_history has any rows. It may
+// exist without any if a run died between creating it and recording the
+// version carried over from schema_migrations.
+func (self *migrator) historyRecorded() (bool, error) {
+	exists, err := self.checkVersionTableExists("migrations_history")
+	if err != nil || !exists {
+		return false, err
+	}
+
+	var recorded bool
+	err = self.db.QueryRow("SELECT EXISTS (SELECT 1 FROM " + self.versionTable("migrations_history") + ")").Scan(&recorded)
+	return recorded, err
+}
+
+// Plan returns the migrations that Migrate(toVersion) would run, in order,
+// along with the statements each would execute. It only reads the current
+// version from the database.
+func (self *migrator) Plan(toVersion int) ([]PlannedMigration, error) {
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := self.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	selected, _, err := self.migrationsBetween(currentVersion, toVersion, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.planMigrations(selected)
+}
+
+// DownPlan returns the down migrations that migrating down to toVersion would
+// run, newest first, along with the statements each would execute, e.g. for
+// review before a downgrade. It is empty if the database is not past
+// toVersion, and only reads the current version from the database.
+func (self *migrator) DownPlan(toVersion int) ([]PlannedMigration, error) {
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return nil, err
+	}
+
+	if currentVersion <= toVersion {
+		return []PlannedMigration{}, nil
+	}
+
+	migrations, err := self.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := self.downMigrations(currentVersion, toVersion, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.planMigrations(selected)
+}
+
+func (self *migrator) planMigrations(selected []migration) ([]PlannedMigration, error) {
+	plan := []PlannedMigration{}
+	for _, m := range selected {
+		statements, err := self.transformStatements(m.Statements)
+		if err != nil {
+			return nil, err
+		}
+
+		plan = append(plan, PlannedMigration{
+			Version:    m.Version,
+			Direction:  m.Direction,
+			Filename:   m.Filename,
+			Statements: statements,
+		})
+	}
+
+	return plan, nil
+}
+
+func (self *migrator) rollbackFailedRun(startVersion int, failed migration, migrations []migration, run runState, cause error) error {
+	if failed.Strategy == SQLNoTransaction {
+		return multierror.Append(cause, fmt.Errorf("not rolling back to version %d: non-transactional migration '%s' may have been partially applied and cannot be reversed automatically", startVersion, failed.Name))
+	}
+
+	failedAtVersion, err := self.CurrentVersion()
+	if err != nil {
+		return multierror.Append(cause, err)
+	}
+
+	self.logger.Info("rolling-back-failed-run", Data{"from": failedAtVersion, "to": startVersion})
+
+	err = self.runDownMigrations(context.Background(), failedAtVersion, startVersion, migrations, run)
+	if err != nil {
+		return multierror.Append(cause, fmt.Errorf("failed to roll back to version %d: %v", startVersion, err))
+	}
+
+	return multierror.Append(cause, fmt.Errorf("rolled back to version %d", startVersion))
+}
+
+// warnIfNotOwner logs when the connected role does not own some of the
+// tables in the current schema, since ALTERing those tables would fail part
+// way through a migration. It is purely advisory.
+func (self *migrator) warnIfNotOwner() {
+	rows, err := self.db.Query("SELECT current_user, tablename, tableowner FROM pg_tables WHERE schemaname = current_schema() AND tableowner != current_user ORDER BY tablename LIMIT 10")
+	if err != nil {
+		self.logger.Error("failed-to-check-table-ownership", err)
+		return
+	}
+
+	defer rows.Close()
+
+	var role string
+	owners := map[string]string{}
+	for rows.Next() {
+		var table, owner string
+		err = rows.Scan(&role, &table, &owner)
+		if err != nil {
+			self.logger.Error("failed-to-check-table-ownership", err)
+			return
+		}
+
+		owners[table] = owner
+	}
+
+	if len(owners) > 0 {
+		self.logger.Info("role-does-not-own-tables", Data{"role": role, "owners": owners})
+	}
+}
+
+type Strategy int
+
+const (
+	GoMigration Strategy = iota
+	SQLTransaction
+	SQLNoTransaction
+)
+
+type migration struct {
+	Name       string
+	Filename   string
+	Version    int
+	Direction  string
+	Statements []Statement
+	Strategy   Strategy
+
+	// Dialects restricts the migration to the dialects of the given names,
+	// as listed by an "-- atc:dialect" header. It runs on every dialect if
+	// there are none.
+	Dialects []string
+
+	// Environments restricts the migration to the environments of the given
+	// names, as listed by an "-- atc:env" header. It runs in every
+	// environment if there are none.
+	Environments []string
+}
+
+// TxMigration is Go code that runs within the transaction of the SQL
+// migration of its version and direction, after the SQL statements, so that
+// both commit or roll back together. See WithTxMigration.
+type TxMigration func(ctx context.Context, tx *sql.Tx, strategy encryption.Strategy) error
+
+type txMigrationKey struct {
+	version   int
+	direction string
+}
+
+// txMigration returns the TxMigration registered for migration, if any.
+func (m *migrator) txMigration(migration migration) (TxMigration, bool) {
+	fn, found := m.txMigrations[txMigrationKey{migration.Version, migration.Direction}]
+	return fn, found
+}
+
+// runsOnDialect reports whether migration is meant for dialect.
+func runsOnDialect(migration migration, dialect Dialect) bool {
+	if len(migration.Dialects) == 0 {
+		return true
+	}
+
+	for _, name := range migration.Dialects {
+		if name == dialect.Name() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runsInEnvironment reports whether migration is meant for the environment
+// set with WithEnvironment.
+func runsInEnvironment(migration migration, environment string) bool {
+	if len(migration.Environments) == 0 {
+		return true
+	}
+
+	for _, name := range migration.Environments {
+		if name == environment {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Statement struct {
+	SQL  string
+	Line int
+
+	// ExpectRows is set by an "-- expect: rows>0" comment above the
+	// statement, failing the migration if the statement affects no rows.
+	ExpectRows bool
+}
+
+func (m *migrator) recordMigrationFailure(migration migration, err error, dirty bool) error {
+	migrationErr, ok := err.(*MigrationError)
+	if !ok {
+		migrationErr = &MigrationError{
+			Name:    migration.Name,
+			Version: migration.Version,
+			Err:     err,
+		}
+	}
+
+	if m.noTracking {
+		return migrationErr
+	}
+
+	_, dbErr := m.db.Exec("INSERT INTO "+m.versionTable("migrations_history")+" (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, $2, 'failed', $3)", migration.Version, migration.Direction, dirty)
+	if dbErr != nil {
+		return multierror.Append(migrationErr, dbErr)
+	}
+
+	return migrationErr
+}
+
+func (m *migrator) transformStatements(statements []Statement) ([]Statement, error) {
+	if m.statementTransform == nil {
+		return statements, nil
+	}
+
+	transformed := make([]Statement, len(statements))
+	for i, statement := range statements {
+		sql, err := m.statementTransform(statement.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform statement %v: %v", statement.SQL, err)
+		}
+
+		transformed[i] = statement
+		transformed[i].SQL = sql
+	}
+
+	return transformed, nil
+}
+
+// failedDirty reports whether the last attempt at migration failed partway
+// through a non-transactional migration, leaving the database dirty.
+func (m *migrator) failedDirty(migration migration) (bool, error) {
+	var (
+		status string
+		dirty  bool
+	)
+	err := m.db.QueryRow("SELECT status, dirty FROM "+m.versionTable("migrations_history")+" WHERE version=$1 AND direction=$2 ORDER BY "+m.dialect.LatestFirst()+" LIMIT 1", migration.Version, migration.Direction).Scan(&status, &dirty)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return status == "failed" && dirty, nil
+}
+
+// dropInvalidConcurrentIndexes cleans up after a previous failed attempt at a
+// non-transactional migration. A failed CREATE INDEX CONCURRENTLY leaves an
+// invalid index behind, which would make the retry fail with "already exists".
+// Indexes that finished building are kept.
+func (m *migrator) dropInvalidConcurrentIndexes(migration migration, statements []Statement) error {
+	dirty, err := m.failedDirty(migration)
+	if err != nil {
+		return err
+	}
+
+	if !dirty {
+		return nil
+	}
+
+	for _, statement := range statements {
+		for _, index := range concurrentIndexNames(statement.SQL) {
+			invalid, err := invalidIndexExists(context.Background(), m.db, index)
+			if err != nil {
+				return err
+			}
+
+			if !invalid {
+				continue
+			}
+
+			m.logger.Info("dropping-index-from-failed-migration", Data{"version": migration.Version, "index": index})
+
+			_, err = m.db.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+const maxTransactionAttempts = 3
+
+// maxRetryingDialectAttempts bounds the attempts made for errors that a
+// TransactionRetrier dialect requires to be retried.
+const maxRetryingDialectAttempts = 10
+
+// shouldRetryTransaction reports whether a transactional migration that
+// failed its attempt-th run should be run again from the start.
+func (m *migrator) shouldRetryTransaction(err error, attempt int) bool {
+	cause := underlyingError(err)
+
+	if retrier, ok := m.dialect.(TransactionRetrier); ok && retrier.RetryTransaction(cause) {
+		return attempt < maxRetryingDialectAttempts
+	}
+
+	return attempt < maxTransactionAttempts && m.errorClassifier.IsRetriable(cause)
+}
+
+func (m *migrator) runTransactionMigration(ctx context.Context, migration migration, statements []Statement) error {
+	start := time.Now()
+
+	var db txBeginner = m.db
+	if m.connPerMigration || m.logNotices {
+		conn, release, err := m.migrationConn(ctx, migration)
+		if err != nil {
+			return err
+		}
+
+		defer release()
+		db = conn
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: m.isolationLevel})
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	for i, statement := range statements {
+		if isEmptyStatement(statement) {
+			m.logger.Debug("skipping-empty-statement", Data{"migration": migration.Name, "line": statement.Line})
+			continue
+		}
+
+		m.logStatementProgress(migration, i, len(statements), statement)
+		m.logQuery(migration, statement)
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, statement.SQL)
+		if err == nil {
+			err = checkRowsAffected(statement, result)
+		}
+
+		if err != nil {
+			return &MigrationError{
+				Name:           migration.Name,
+				Version:        migration.Version,
+				Statement:      statement,
+				StatementIndex: i + 1,
+				RolledBack:     true,
+				Err:            err,
+			}
+		}
+	}
+
+	if fn, found := m.txMigration(migration); found {
+		err = fn(ctx, tx, m.strategy)
+		if err != nil {
+			return &MigrationError{
+				Name:       migration.Name,
+				Version:    migration.Version,
+				RolledBack: true,
+				Err:        err,
+			}
+		}
+	}
+
+	err = m.recordTiming(tx, migration, start)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	committed = true
+	return nil
+}
+
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// migrationConn returns a connection of its own for running a migration file,
+// along with a func to release it. With WithConnectionPerMigration the
+// connection is closed rather than returned to the pool on release, so that
+// session settings made by the file, e.g. SET search_path, cannot leak into
+// later files. With WithNoticeLogging the notices raised on the connection
+// are logged, tagged with the version of migration, until it is released.
+func (m *migrator) migrationConn(ctx context.Context, migration migration) (*sql.Conn, func(), error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.logNotices {
+		err = conn.Raw(func(driverConn interface{}) error {
+			return m.setNoticeHandler(driverConn.(driver.Conn), m.noticeLogger(migration))
+		})
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	release := func() {
+		if m.logNotices {
+			_ = conn.Raw(func(driverConn interface{}) error {
+				return m.setNoticeHandler(driverConn.(driver.Conn), nil)
+			})
+		}
+
+		if m.connPerMigration {
+			// a connection reported as bad is closed instead of being pooled
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+
+		conn.Close()
+	}
+
+	return conn, release, nil
+}
+
+// pqPackage is the import path of lib/pq, vendored or not.
+var pqPackage = reflect.TypeOf(pq.Driver{}).PkgPath()
+
+// setPQNoticeHandler sets the notice handler of a lib/pq connection. It fails
+// for the connections of other drivers, which lib/pq would panic on.
+func setPQNoticeHandler(conn driver.Conn, handler func(*pq.Error)) error {
+	connType := reflect.TypeOf(conn)
+	if connType.Kind() == reflect.Ptr {
+		connType = connType.Elem()
+	}
+
+	if connType.PkgPath() != pqPackage {
+		return fmt.Errorf("WithNoticeLogging requires a lib/pq connection, not %T", conn)
+	}
+
+	pq.SetNoticeHandler(conn, handler)
+	return nil
+}
+
+// checkNoticeLogging fails for WithNoticeLogging unless the notice handler
+// can be set on the connections of the database, before any migration is
+// attempted.
+func (m *migrator) checkNoticeLogging(ctx context.Context) error {
+	if !m.logNotices {
+		return nil
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		return m.setNoticeHandler(driverConn.(driver.Conn), nil)
+	})
+}
+
+// noticeLogger returns a handler logging the notices the database raises
+// while running migration, with warnings logged as errors since they often
+// point out costly DDL, e.g. that a table will be rewritten.
+func (m *migrator) noticeLogger(migration migration) func(*pq.Error) {
+	return func(notice *pq.Error) {
+		data := Data{"version": migration.Version, "severity": notice.Severity, "message": notice.Message}
+		if notice.Detail != "" {
+			data["detail"] = notice.Detail
+		}
+
+		if notice.Hint != "" {
+			data["hint"] = notice.Hint
+		}
+
+		switch notice.Severity {
+		case "WARNING":
+			m.logger.Error("database-warning", notice, data)
+		case "DEBUG", "LOG":
+			m.logger.Debug("database-notice", data)
+		default:
+			m.logger.Info("database-notice", data)
+		}
+	}
+}
+
+func checkRowsAffected(statement Statement, result sql.Result) error {
+	if !statement.ExpectRows {
+		return nil
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordTiming records how long a migration took in migration_timings,
+// within the migration's own transaction where it has one.
+func (m *migrator) recordTiming(db execer, migration migration, start time.Time) error {
+	if m.noTracking {
+		return nil
+	}
+
+	duration := time.Since(start) / time.Millisecond
+
+	_, err := db.Exec("INSERT INTO "+m.versionTable("migration_timings")+" (version, direction, tstamp, duration_ms) VALUES ($1, $2, current_timestamp, $3)", migration.Version, migration.Direction, int64(duration))
+	return err
+}
+
+// runNoTransactionMigration runs a non-transactional migration on a single
+// dedicated connection, so that every statement runs in autocommit mode on
+// the same session regardless of the state of other pooled connections.
+//
+// When resuming a migration that left the database dirty, the statements
+// migration_progress records as completed are skipped, and of the rest,
+// existing indexes and ignorable errors are skipped, as with
+// WithSkipExistingIndexes. Otherwise any recorded progress is discarded.
+func (m *migrator) runNoTransactionMigration(ctx context.Context, migration migration, statement Statement, resuming bool) error {
+	conn, release, err := m.migrationConn(ctx, migration)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	completed := 0
+	if !m.noTracking {
+		if resuming {
+			completed, err = m.completedStatements(ctx, conn, migration)
+		} else {
+			err = m.clearStatementProgress(ctx, conn, migration)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.execNoTransactionStatements(ctx, conn, migration, statement, completed, m.skipExistingIndexes || resuming)
+}
+
+// execNoTransactionStatements runs each statement of a non-transactional
+// migration separately, so that a failure is reported against the statement
+// that failed, skipping the first completed statements. With skipExisting,
+// index builds whose index already exists and statements failing with
+// ignorable errors are skipped. Unless tracking is disabled, the index of
+// each statement is recorded in migration_progress once it is done.
+func (m *migrator) execNoTransactionStatements(ctx context.Context, conn *sql.Conn, migration migration, noTxStatement Statement, completed int, skipExisting bool) error {
+	statements, err := splitIntoStatements(noTxStatement.SQL)
+	if err != nil {
+		return err
+	}
+
+	for i, statement := range statements {
+		if i < completed {
+			m.logger.Info("skipping-completed-statement", Data{"version": migration.Version, "statement": i + 1, "line": statement.Line})
+			continue
+		}
+
+		err = m.execNoTransactionStatement(ctx, conn, migration, statement, i, len(statements), skipExisting)
+		if err != nil {
+			return err
+		}
+
+		err = m.recordStatementProgress(ctx, conn, migration, i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execNoTransactionStatement runs the statement at index i of the total
+// statements of a non-transactional migration; see
+// execNoTransactionStatements.
+func (m *migrator) execNoTransactionStatement(ctx context.Context, conn *sql.Conn, migration migration, statement Statement, i, total int, skipExisting bool) error {
+	indexes := concurrentIndexNames(statement.SQL)
+	if skipExisting && len(indexes) == 1 {
+		exists, err := validIndexExists(ctx, conn, indexes[0])
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			m.logger.Info("skipping-existing-index", Data{"version": migration.Version, "index": indexes[0]})
+			return nil
+		}
+	}
+
+	m.logStatementProgress(migration, i, total, statement)
+	m.logQuery(migration, statement)
+
+	result, err := conn.ExecContext(ctx, statement.SQL)
+	if err == nil {
+		err = checkRowsAffected(statement, result)
+	}
+
+	if err != nil {
+		if skipExisting && m.errorClassifier.IsIgnorable(err) {
+			m.logger.Info("ignoring-statement-error", Data{"version": migration.Version, "line": statement.Line, "error": err.Error()})
+			return nil
+		}
+
+		return &MigrationError{
+			Name:           migration.Name,
+			Version:        migration.Version,
+			Statement:      statement,
+			StatementIndex: i + 1,
+			Err:            err,
+		}
+	}
+
+	return nil
+}
+
+// completedStatements returns how many leading statements of a
+// non-transactional migration migration_progress records as done by the
+// previous attempt at it.
+func (m *migrator) completedStatements(ctx context.Context, conn *sql.Conn, migration migration) (int, error) {
+	var completed int
+	err := conn.QueryRowContext(ctx, "SELECT statement_index FROM "+m.versionTable("migration_progress")+" WHERE version=$1 AND direction=$2", migration.Version, migration.Direction).Scan(&completed)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return completed, err
+}
+
+// recordStatementProgress records in migration_progress that the statements
+// of a non-transactional migration up to the 1-based index are done, so that
+// resuming it with WithAutoResumeDirty does not run them again.
+func (m *migrator) recordStatementProgress(ctx context.Context, conn *sql.Conn, migration migration, index int) error {
+	if m.noTracking {
+		return nil
+	}
+
+	_, err := conn.ExecContext(ctx, "DELETE FROM "+m.versionTable("migration_progress")+" WHERE version=$1 AND direction=$2", migration.Version, migration.Direction)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "INSERT INTO "+m.versionTable("migration_progress")+" (version, direction, statement_index) VALUES ($1, $2, $3)", migration.Version, migration.Direction, index)
+	return err
+}
+
+// clearStatementProgress discards the progress recorded for a
+// non-transactional migration, once it passed or when it is run from the
+// start.
+func (m *migrator) clearStatementProgress(ctx context.Context, db contextExecer, migration migration) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM "+m.versionTable("migration_progress")+" WHERE version=$1 AND direction=$2", migration.Version, migration.Direction)
+	return err
+}
+
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type contextExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// validIndexExists looks up an index, named as written in a CREATE INDEX
+// statement, in the schemas on the search path.
+func validIndexExists(ctx context.Context, db rowQuerier, name string) (bool, error) {
+	return indexExists(ctx, db, name, true)
+}
+
+// invalidIndexExists looks up an index like validIndexExists, but one left
+// invalid by a failed CREATE INDEX CONCURRENTLY.
+func invalidIndexExists(ctx context.Context, db rowQuerier, name string) (bool, error) {
+	return indexExists(ctx, db, name, false)
+}
+
+func indexExists(ctx context.Context, db rowQuerier, name string, valid bool) (bool, error) {
+	if strings.HasPrefix(name, `"`) {
+		name = strings.Trim(name, `"`)
+	} else {
+		name = strings.ToLower(name)
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_index
+			JOIN pg_class ON pg_class.oid = pg_index.indexrelid
+			WHERE pg_class.relname = $1
+			AND pg_table_is_visible(pg_class.oid)
+			AND pg_index.indisvalid = $2
+		)`, name, valid).Scan(&exists)
+	return exists, err
+}
+
+// logQuery logs a statement about to be executed, with anything matching the
+// redact patterns masked, when query logging is enabled.
+func (m *migrator) logQuery(migration migration, statement Statement) {
+	if !m.logQueries {
+		return
+	}
+
+	query := statement.SQL
+	for _, pattern := range m.redactPatterns {
+		query = pattern.ReplaceAllString(query, "***")
+	}
+
+	m.logger.Debug("executing-statement", Data{"version": migration.Version, "line": statement.Line, "sql": query})
+}
+
+func (m *migrator) logStatementProgress(migration migration, index int, total int, statement Statement) {
+	if !m.statementProgress {
+		return
+	}
+
+	m.logger.Info("applying-statement", Data{
+		"version":   migration.Version,
+		"statement": fmt.Sprintf("%d/%d", index+1, total),
+		"line":      statement.Line,
+	})
+}
+
+// isEmptyStatement reports whether a statement has nothing to execute, e.g.
+// because a statement transform blanked it. Drivers report confusing errors
+// for these, so they are skipped.
+func isEmptyStatement(statement Statement) bool {
+	return strings.TrimSpace(statement.SQL) == ""
+}
+
+// isEmptyMigration reports whether a SQL migration consists only of
+// whitespace and comments, e.g. a placeholder down migration. Such migrations
+// are valid: their version is recorded without executing anything.
+func isEmptyMigration(migration migration, statements []Statement) bool {
+	switch migration.Strategy {
+	case SQLTransaction:
+		for _, statement := range statements {
+			if !isEmptyStatement(statement) {
+				return false
+			}
+		}
+
+		return true
+	case SQLNoTransaction:
+		pieces, err := splitIntoStatements(statements[0].SQL)
+		return err == nil && len(pieces) == 0
+	default:
+		return false
+	}
+}
+
+// runState holds what a migration run learned about the state the database
+// was left in by earlier runs. It is passed along rather than kept on the
+// migrator, which may be migrating concurrently.
+type runState struct {
+	// recovering is set when a previous run died mid-way, see markMigrating.
+	recovering bool
+
+	// dirtyLegacyVersion is the version a legacy schema_migrations table was
+	// left dirty at, which is being resumed with WithAutoResumeDirty.
+	dirtyLegacyVersion int
+}
+
+func (m *migrator) runMigration(ctx context.Context, migration migration, run runState) error {
+	var err error
+
+	// skipping an environment-specific migration records it as applied for
+	// good, so it must not be skipped merely for lack of an environment
+	if len(migration.Environments) > 0 && m.environment == "" {
+		return fmt.Errorf("migration %d only runs in the environments %s, but no environment is set with WithEnvironment", migration.Version, strings.Join(migration.Environments, ", "))
+	}
+
+	statements, err := m.transformStatements(migration.Statements)
+	if err != nil {
+		return m.recordMigrationFailure(migration, err, false)
+	}
+
+	data := Data{"version": migration.Version, "direction": migration.Direction}
+	if migration.Strategy != GoMigration {
+		data["statements"] = len(statements)
+	}
+	m.logger.Info("applying-migration", data)
+
+	start := time.Now()
+
+	_, hasTxMigration := m.txMigration(migration)
+
+	switch {
+	case !runsOnDialect(migration, m.dialect):
+		// recorded all the same, so that versions line up across dialects
+		m.logger.Info("skipping-migration-for-other-dialect", Data{"version": migration.Version, "direction": migration.Direction, "dialects": migration.Dialects})
+
+		err = m.recordTiming(m.db, migration, start)
+		if err != nil {
+			return err
+		}
+	case !runsInEnvironment(migration, m.environment):
+		m.logger.Info("skipping-migration-for-other-environment", Data{"version": migration.Version, "direction": migration.Direction, "environments": migration.Environments, "environment": m.environment})
+
+		err = m.recordTiming(m.db, migration, start)
+		if err != nil {
+			return err
+		}
+	case isEmptyMigration(migration, statements) && !hasTxMigration:
+		m.logger.Info("skipping-empty-migration", Data{"version": migration.Version, "direction": migration.Direction})
+
+		err = m.recordTiming(m.db, migration, start)
+		if err != nil {
+			return err
+		}
+	case migration.Strategy == GoMigration:
+		err = migrations.NewMigrations(m.db, m.strategy).Run(migration.Name)
+		if err != nil {
+			return m.recordMigrationFailure(migration, err, false)
+		}
+
+		err = m.recordTiming(m.db, migration, start)
+		if err != nil {
+			return err
+		}
+	case migration.Strategy == SQLTransaction:
+		for attempt := 1; ; attempt++ {
+			err = m.runTransactionMigration(ctx, migration, statements)
+			if err == nil {
+				break
+			}
+
+			if ctx.Err() != nil {
+				_ = m.recordMigrationFailure(migration, err, false)
+				return ctx.Err()
+			}
+
+			if !m.shouldRetryTransaction(err, attempt) {
+				return m.recordMigrationFailure(migration, err, false)
+			}
+
+			m.logger.Info("retrying-migration", Data{"version": migration.Version, "attempt": attempt + 1, "error": err.Error()})
+
+			if m.onRetry != nil {
+				statementIndex := 0
+				if migrationErr, ok := err.(*MigrationError); ok {
+					statementIndex = migrationErr.StatementIndex
+				}
+
+				m.onRetry(migration.Version, statementIndex, attempt+1, underlyingError(err))
+			}
+		}
+	case migration.Strategy == SQLNoTransaction:
+		if hasTxMigration {
+			return m.recordMigrationFailure(migration, fmt.Errorf("cannot run the Go migration of version %d in a transaction, as its SQL migration runs outside of one", migration.Version), false)
+		}
+
+		resuming := false
+		if !m.noTracking {
+			err = m.dropInvalidConcurrentIndexes(migration, statements)
+			if err != nil {
+				return m.recordMigrationFailure(migration, err, true)
+			}
+
+			if m.autoResumeDirty {
+				resuming, err = m.failedDirty(migration)
+				if err != nil {
+					return m.recordMigrationFailure(migration, err, true)
+				}
+
+				resuming = resuming || migration.Version == run.dirtyLegacyVersion
+			}
+		}
+
+		if resuming {
+			m.logger.Info("resuming-dirty-migration", Data{"version": migration.Version, "direction": migration.Direction})
+		}
+
+		err = m.runNoTransactionMigration(ctx, migration, statements[0], run.recovering || resuming)
+		if err != nil {
+			return m.recordMigrationFailure(migration, err, true)
+		}
+
+		err = m.recordTiming(m.db, migration, start)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.noTracking {
+		return nil
+	}
+
+	_, err = m.db.Exec("INSERT INTO "+m.versionTable("migrations_history")+" (version, tstamp, direction, status, dirty) VALUES ($1, current_timestamp, $2, 'passed', false)", migration.Version, migration.Direction)
+	if err != nil {
+		return err
+	}
+
+	if migration.Strategy == SQLNoTransaction {
+		return m.clearStatementProgress(ctx, m.db, migration)
+	}
+
+	return nil
+}
+
+func (self *migrator) Migrations() ([]migration, error) {
+	migrationList := []migration{}
+	assets := self.bindata.AssetNames()
+	var parser = self.newParser()
+	for _, assetName := range assets {
+		parsedMigration, err := parser.ParseFileToMigration(assetName)
+		if err != nil {
+			return nil, err
+		}
+		migrationList = append(migrationList, parsedMigration)
+	}
+
+	sortMigrations(migrationList)
+
+	return migrationList, nil
+}
+
+func (self *migrator) Up() error {
+	return self.UpToSupported()
+}
+
+// UpToSupported migrates up to exactly SupportedVersion.
+func (self *migrator) UpToSupported() error {
+	return self.UpWithProgress(nil)
+}
+
+// UpWithProgress migrates up to SupportedVersion like UpToSupported, calling
+// progress after each migration file with the number of files applied so far
+// and the total number to apply, e.g. to drive a progress bar.
+func (self *migrator) UpWithProgress(progress func(done, total int)) error {
+	if len(self.supportedVersions) == 0 && self.allowEmpty {
+		return nil
+	}
+
+	version, err := self.SupportedVersion()
+	if err != nil {
+		return err
+	}
+
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return err
+	}
+
+	if currentVersion != 0 && currentVersion < self.minSupportedVersion {
+		return &UnsupportedVersionError{CurrentVersion: currentVersion, MinSupportedVersion: self.minSupportedVersion}
+	}
+
+	unknown, err := self.unknownAppliedVersions()
+	if err != nil {
+		return err
+	}
+
+	if len(unknown) > 0 {
+		return &UnknownAppliedVersionsError{Versions: unknown}
+	}
+
+	self.logPendingMigrations(currentVersion, version)
+
+	result, err := self.migrate(context.Background(), version, progress)
+	if err != nil {
+		return err
+	}
+
+	if result.unchanged() {
+		return ErrNoChange
+	}
+
+	self.logger.Info("migrated-to-supported-version", Data{"from": result.FromVersion, "to": result.ToVersion, "applied": result.AppliedVersions})
+
+	if self.postMigrateAnalyze && len(result.Applied) > 0 {
+		return self.analyze()
+	}
+
+	return nil
+}
+
+// analyze refreshes the planner statistics of the whole database, which
+// migrations moving lots of data leave stale.
+func (self *migrator) analyze() error {
+	start := time.Now()
+
+	_, err := self.db.Exec("ANALYZE")
+	if err != nil {
+		return err
+	}
+
+	self.logger.Info("analyzed-database", Data{"duration": time.Since(start).String()})
+
+	return nil
+}
+
+// logPendingMigrations logs how far the database is behind supportedVersion,
+// so that every boot records the versions it migrates between.
+func (self *migrator) logPendingMigrations(currentVersion int, supportedVersion int) {
+	if currentVersion == supportedVersion {
+		self.logger.Info("database-up-to-date", Data{"version": currentVersion})
+		return
+	}
+
+	pending := 0
+	for _, version := range self.supportedVersions {
+		if currentVersion < version && version <= supportedVersion {
+			pending++
+		}
+	}
+
+	self.logger.Info("migrating-to-supported-version", Data{"from": currentVersion, "to": supportedVersion, "pending": pending})
+}
+
+// UpOne applies the single migration following the current version. It is
+// meant for stepping through migrations while debugging them.
+func (self *migrator) UpOne() error {
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return err
+	}
+
+	for _, version := range self.supportedVersions {
+		if version > currentVersion {
+			return self.Migrate(version)
+		}
+	}
+
+	return ErrNoMoreMigrations
+}
+
+// DownOne reverts the migration of the current version.
+func (self *migrator) DownOne() error {
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return err
+	}
+
+	if currentVersion == 0 {
+		return ErrNoMoreMigrations
+	}
+
+	previousVersion := 0
+	for _, version := range self.supportedVersions {
+		if version >= currentVersion {
+			break
+		}
+		previousVersion = version
+	}
+
+	return self.Migrate(previousVersion)
+}
+
+// UpToLatestMinus migrates up to the version n before SupportedVersion, e.g.
+// to keep a canary database one migration behind. It never migrates down,
+// failing instead if the database is already past that version.
+func (self *migrator) UpToLatestMinus(n int) error {
+	if n < 0 || n >= len(self.supportedVersions) {
+		return fmt.Errorf("cannot migrate to %d versions before the latest of %d migrations", n, len(self.supportedVersions))
+	}
+
+	toVersion := self.supportedVersions[len(self.supportedVersions)-1-n]
+
+	currentVersion, err := self.versionBeforeMigrating()
+	if err != nil {
+		return err
+	}
+
+	if currentVersion > toVersion {
+		return fmt.Errorf("database is at version %d, which is past version %d; refusing to migrate down", currentVersion, toVersion)
+	}
+
+	return self.Migrate(toVersion)
+}
+
+// Repair migrates down to the knownGood version and then back up to
+// SupportedVersion, holding the migration lock throughout so that no other
+// migrator runs in between, e.g. to recover from a botched manual change to
+// the schema of the later versions.
+func (self *migrator) Repair(knownGood int) error {
+	if self.configErr != nil {
+		return self.configErr
+	}
+
+	if len(self.supportedVersions) == 0 {
+		return ErrNoMigrations
+	}
+
+	err := self.checkDownFiles()
+	if err != nil {
+		return err
+	}
+
+	lock, err := self.acquireLock()
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		defer lock.Release()
+	}
+
+	self.logger.Info("repair-rolling-back", Data{"to": knownGood})
+
+	_, err = self.migrateLocked(context.Background(), knownGood, nil)
+	if err != nil {
+		return err
+	}
+
+	supportedVersion, err := self.SupportedVersion()
+	if err != nil {
+		return err
+	}
+
+	self.logger.Info("repair-reapplying", Data{"to": supportedVersion})
+
+	_, err = self.migrateLocked(context.Background(), supportedVersion, nil)
+	if err != nil {
+		return err
+	}
+
+	self.logger.Info("repaired", Data{"known-good": knownGood, "version": supportedVersion})
+
+	return nil
+}
+
+// Baseline records every supported version after the current one, up to and
+// including version, as applied without running their migrations. This is
+// for databases whose schema was created by other means, e.g. restored from
+// a dump taken without the migrations_history table.
+func (self *migrator) Baseline(version int) error {
+	if !self.isSupportedVersion(version) {
+		return fmt.Errorf("cannot baseline to version %d: no migration has that version", version)
+	}
+
+	lock, err := self.acquireLock()
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		defer lock.Release()
+	}
+
+	_, err = self.db.Exec(self.dialect.CreateVersionTable(self.versionTable("migrations_history")))
+	if err != nil {
+		return err
+	}
+
+	currentVersion, err := self.CurrentVersion()
+	if err != nil {
+		return err
+	}
+
+	var versions []int
+	for _, supported := range self.supportedVersions {
+		if currentVersion < supported && supported <= version {
+			versions = append(versions, supported)
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil
+	}
+
+	err = self.recordVersions(versions)
+	if err != nil {
+		return err
+	}
+
+	self.logger.Info("baselined", Data{"from": currentVersion, "to": version, "versions": len(versions)})
+
+	return nil
+}
+
+func (self *migrator) isSupportedVersion(version int) bool {
+	for _, supported := range self.supportedVersions {
+		if supported == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordVersions records the given versions as passed up migrations in a
+// single statement, as there may be hundreds of them.
+func (self *migrator) recordVersions(versions []int) error {
+	values := make([]string, len(versions))
+	args := make([]interface{}, len(versions))
+	for i, version := range versions {
+		values[i] = fmt.Sprintf("($%d, current_timestamp, 'up', 'passed', false)", i+1)
+		args[i] = version
+	}
+
+	_, err := self.db.Exec("INSERT INTO "+self.versionTable("migrations_history")+" (version, tstamp, direction, status, dirty) VALUES "+strings.Join(values, ", "), args...)
+	return err
+}
+
+// TimingRecord is how long one run of a migration took.
+type TimingRecord struct {
+	Version   int
+	Direction string
+	AppliedAt time.Time
+	Duration  time.Duration
+}
+
+// Timings lists every recorded run of the given version, oldest first, to
+// follow how the cost of a migration changes as the data grows.
+func (self *migrator) Timings(version int) ([]TimingRecord, error) {
+	if !self.versionTableExists("migration_timings") {
+		return nil, nil
+	}
+
+	rows, err := self.db.Query("SELECT direction, tstamp, duration_ms FROM "+self.versionTable("migration_timings")+" WHERE version=$1 ORDER BY tstamp ASC", version)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	timings := []TimingRecord{}
+	for rows.Next() {
+		record := TimingRecord{Version: version}
+
+		var durationMS int64
+		err = rows.Scan(&record.Direction, &record.AppliedAt, &durationMS)
+		if err != nil {
+			return nil, err
+		}
+
+		record.Duration = time.Duration(durationMS) * time.Millisecond
+		timings = append(timings, record)
+	}
+
+	return timings, rows.Err()
+}
+
+// VersionTableRow is one row of migrations_history, as exported by
+// ExportVersionTable. Name is the migration file recorded by the row, if it
+// is still known to the migrator.
+type VersionTableRow struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"`
+	Status    string    `json:"status"`
+	AppliedAt time.Time `json:"applied_at"`
+	Dirty     bool      `json:"dirty"`
+}
+
+// ExportVersionTable dumps migrations_history as a JSON array of
+// VersionTableRow, newest first, for inclusion in support bundles.
+func (self *migrator) ExportVersionTable() ([]byte, error) {
+	history := []VersionTableRow{}
+
+	if self.versionTableExists("migrations_history") {
+		rows, err := self.db.Query("SELECT version, direction, status, tstamp, dirty FROM " + self.versionTable("migrations_history") + " ORDER BY " + self.dialect.LatestFirst())
+		if err != nil {
+			return nil, err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var row VersionTableRow
+			err = rows.Scan(&row.Version, &row.Direction, &row.Status, &row.AppliedAt, &row.Dirty)
+			if err != nil {
+				return nil, err
+			}
+
+			if row.Direction == "down" {
+				row.Name, _ = self.downAsset(row.Version)
+			} else {
+				row.Name, _ = self.upAsset(row.Version)
+			}
+
+			history = append(history, row)
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(history)
+}
+
+func (self *migrator) CompactHistory(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("cannot keep a negative number of history rows: %d", keep)
+	}
+
+	lock, err := self.acquireLock()
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		defer lock.Release()
+	}
+
+	if !self.versionTableExists("migrations_history") {
+		return nil
+	}
+
+	// the newest passed row determines the current version, so it must be kept
+	// no matter how many newer failed rows there are
+	result, err := self.db.Exec(fmt.Sprintf(`
+		DELETE FROM %[3]s
+		WHERE %[1]s NOT IN (SELECT %[1]s FROM %[3]s ORDER BY %[2]s LIMIT $1)
+		AND %[1]s NOT IN (SELECT %[1]s FROM %[3]s WHERE status!='failed' ORDER BY %[2]s LIMIT 1)
+	`, self.dialect.RowID(), self.dialect.LatestFirst(), self.versionTable("migrations_history")), keep)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	self.logger.Info("compacted-history", Data{"deleted": deleted, "keep": keep})
+
+	return nil
+}
+
+// ReconcileReport compares the versions recorded in migrations_history with
+// the known migrations.
+type ReconcileReport struct {
+	CurrentVersion int
+
+	// Missing lists known versions up to the current one that are not
+	// recorded as applied, ignoring those before the first recorded version
+	// since the history of upgraded databases starts part way through.
+	Missing []int
+
+	// Extra lists versions recorded as applied that have no migration.
+	Extra []int
+}
+
+// Reconcile reports how the recorded history has drifted from the known
+// migrations without changing anything, e.g. after the schema was modified
+// by hand.
+func (self *migrator) Reconcile() (ReconcileReport, error) {
+	report := ReconcileReport{Missing: []int{}, Extra: []int{}}
+
+	if !self.versionTableExists("migrations_history") {
+		return report, nil
+	}
+
+	var err error
+	report.CurrentVersion, err = self.CurrentVersion()
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := self.db.Query("SELECT version, direction FROM " + self.versionTable("migrations_history") + " WHERE status!='failed' ORDER BY " + self.dialect.LatestFirst())
+	if err != nil {
+		return report, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	recorded := map[int]bool{}
+	firstRecorded := -1
+	for rows.Next() {
+		var (
+			version   int
+			direction string
+		)
+		err = rows.Scan(&version, &direction)
+		if err != nil {
+			return report, err
+		}
+
+		if firstRecorded == -1 || version < firstRecorded {
+			firstRecorded = version
+		}
+
+		// only the latest row of each version says whether it is applied
+		if !recorded[version] {
+			recorded[version] = true
+			applied[version] = direction == "up"
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+
+	known := map[int]bool{}
+	for _, version := range self.supportedVersions {
+		known[version] = true
+
+		if firstRecorded <= version && version <= report.CurrentVersion && !applied[version] {
+			report.Missing = append(report.Missing, version)
+		}
+	}
+
+	for version, isApplied := range applied {
+		if isApplied && !known[version] {
+			report.Extra = append(report.Extra, version)
+		}
+	}
+
+	sort.Ints(report.Extra)
+
+	return report, nil
+}
+
+// unknownAppliedVersions returns the versions recorded as applied that have
+// no migration, ignoring those before the oldest migration, which predate the
+// migrations shipped, e.g. versions recorded by a legacy migrator.
+func (self *migrator) unknownAppliedVersions() ([]int, error) {
+	if len(self.supportedVersions) == 0 {
+		return nil, nil
+	}
+
+	report, err := self.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []int
+	for _, version := range report.Extra {
+		if version > self.supportedVersions[0] {
+			unknown = append(unknown, version)
+		}
+	}
+
+	return unknown, nil
+}
+
+// Verify checks that the migrations_history table is consistent with the
+// known migrations, reporting every discrepancy at once rather than stopping
+// at the first.
+func (self *migrator) Verify() error {
+	if !self.versionTableExists("migrations_history") {
+		return nil
+	}
+
+	known := map[int]bool{}
+	for _, version := range self.SupportedVersions() {
+		known[version] = true
+	}
+
+	rows, err := self.db.Query("SELECT DISTINCT version FROM " + self.versionTable("migrations_history") + " WHERE status!='failed' ORDER BY version")
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var discrepancies error
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			return err
+		}
+
+		if !known[version] {
+			discrepancies = multierror.Append(discrepancies, fmt.Errorf("applied version %d has no matching migration", version))
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var (
+		version int
+		dirty   bool
+	)
+	err = self.db.QueryRow("SELECT version, dirty FROM "+self.versionTable("migrations_history")+" ORDER BY "+self.dialect.LatestFirst()+" LIMIT 1").Scan(&version, &dirty)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if dirty {
+		discrepancies = multierror.Append(discrepancies, fmt.Errorf("version %d is in a dirty state", version))
+	}
+
+	return discrepancies
+}
+
+// CheckInvariants replays the passed rows of migrations_history, oldest
+// first, and reports every row that could not have been written by a correct
+// sequence of runs: a version applied again without being reverted, reverted
+// again without being applied, applied while a newer version was, or reverted
+// before a newer one. Together these ensure that the number of up rows minus
+// the number of down rows is the number of applied versions, even across
+// restarts. A version whose history starts with a down row is assumed to
+// have had its older rows removed by CompactHistory.
+func (self *migrator) CheckInvariants() error {
+	if !self.versionTableExists("migrations_history") {
+		return nil
+	}
+
+	rows, err := self.db.Query("SELECT version, direction FROM " + self.versionTable("migrations_history") + " WHERE status!='failed' ORDER BY " + self.dialect.LatestFirst())
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	type historyRow struct {
+		version   int
+		direction string
+	}
+
+	var history []historyRow
+	for rows.Next() {
+		var row historyRow
+		err = rows.Scan(&row.version, &row.direction)
+		if err != nil {
+			return err
+		}
+
+		history = append(history, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var violations error
+	applied := map[int]bool{}
+	seen := map[int]bool{}
+	for i := len(history) - 1; i >= 0; i-- {
+		row := history[i]
+
+		newest := 0
+		for version := range applied {
+			if version > newest {
+				newest = version
+			}
+		}
+
+		switch {
+		case row.direction == "up" && applied[row.version]:
+			violations = multierror.Append(violations, fmt.Errorf("version %d recorded as applied again without being reverted", row.version))
+		case row.direction == "up" && row.version < newest:
+			violations = multierror.Append(violations, fmt.Errorf("version %d recorded as applied after newer version %d", row.version, newest))
+		case row.direction == "down" && seen[row.version] && !applied[row.version]:
+			violations = multierror.Append(violations, fmt.Errorf("version %d recorded as reverted again without being applied", row.version))
+		case row.direction == "down" && applied[row.version] && row.version < newest:
+			violations = multierror.Append(violations, fmt.Errorf("version %d recorded as reverted before newer version %d", row.version, newest))
+		}
+
+		seen[row.version] = true
+		if row.direction == "up" {
+			applied[row.version] = true
+		} else {
+			delete(applied, row.version)
+		}
+	}
+
+	return violations
+}
+
+// RoundTripCheck migrates up, all the way down and up again, failing unless
+// every step succeeds and the database ends at SupportedVersion. It proves
+// that each down migration undoes its up migration well enough for it to
+// run again, and is meant for CI against a scratch database.
+func (self *migrator) RoundTripCheck() error {
+	err := self.Up()
+	if err != nil && err != ErrNoChange {
+		return fmt.Errorf("first up: %v", err)
+	}
+
+	err = self.Migrate(0)
+	if err != nil && err != ErrNoChange {
+		return fmt.Errorf("down to 0: %v", err)
+	}
+
+	err = self.Up()
+	if err != nil && err != ErrNoChange {
+		return fmt.Errorf("second up: %v", err)
+	}
+
+	supportedVersion, err := self.SupportedVersion()
+	if err != nil {
+		return err
+	}
+
+	currentVersion, err := self.CurrentVersion()
+	if err != nil {
+		return err
+	}
+
+	if currentVersion != supportedVersion {
+		return fmt.Errorf("ended at version %d instead of %d", currentVersion, supportedVersion)
+	}
+
+	return nil
+}
+
+// markMigrating records in migration_state that a migration is in progress,
+// reporting whether a row was left behind by a migrator that died mid-run.
+// That row is replaced, which is safe as the migration lock is held.
+//
+// The interrupted run may have applied a NO_TRANSACTION migration without
+// recording it, so the rerun resumes it like WithAutoResumeDirty does, after
+// the statements recorded as done and skipping the objects that already
+// exist, and then records the version.
+func (self *migrator) markMigrating() (bool, error) {
+	_, err := self.db.Exec(self.dialect.CreateStateTable(self.versionTable("migration_state")))
+	if err != nil {
+		return false, err
+	}
+
+	var interrupted bool
+	err = self.db.QueryRow("SELECT EXISTS (SELECT 1 FROM " + self.versionTable("migration_state") + ")").Scan(&interrupted)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = self.db.Exec("DELETE FROM " + self.versionTable("migration_state"))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = self.db.Exec("INSERT INTO " + self.versionTable("migration_state") + " (started_at) VALUES (current_timestamp)")
+	return interrupted, err
+}
+
+func (self *migrator) clearMigrating() {
+	_, err := self.db.Exec("DELETE FROM " + self.versionTable("migration_state"))
+	if err != nil {
+		self.logger.Error("failed-to-clear-migration-state", err)
+	}
+}
+
+// IsMigrating reports whether a migration is in progress, so that other
+// processes can back off from work that would conflict with it. It neither
+// takes nor waits for the migration lock.
+func (self *migrator) IsMigrating() (bool, error) {
+	if !self.versionTableExists("migration_state") {
+		return false, nil
+	}
+
+	var migrating bool
+	err := self.db.QueryRow("SELECT EXISTS (SELECT 1 FROM " + self.versionTable("migration_state") + ")").Scan(&migrating)
+	if err != nil {
+		return false, err
+	}
+
+	return migrating, nil
+}
+
+func (self *migrator) acquireLock() (lock.Lock, error) {
+	return self.AcquireLock(context.Background())
+}
+
+// AcquireLock waits for the lock held while migrating, so that other
+// maintenance can be coordinated with migrations. The caller must Release
+// the returned lock, which is nil if the migrator has no lock factory or its
+// dialect does not use AdvisoryLock.
+//
+// While another session holds the lock, a heartbeat is logged periodically
+// so that a wait is distinguishable from a hang. Connection errors are
+// retried for up to the WithLockErrorTimeout duration.
+func (self *migrator) AcquireLock(ctx context.Context) (lock.Lock, error) {
+
+	var err error
+	var acquired bool
+	var newLock lock.Lock
+
+	if self.lockFactory != nil && self.dialect.LockStrategy() == AdvisoryLock {
+		start := time.Now()
+		lastHeartbeat := start
+
+		var failingSince time.Time
+
+		for {
+			newLock, acquired, err = self.lockFactory.Acquire(self.lockLogger(), self.lockID)
+
+			if err != nil {
+				if !isTransientConnError(err) {
+					return nil, err
+				}
+
+				if failingSince.IsZero() {
+					failingSince = time.Now()
+				} else if time.Since(failingSince) >= self.lockErrorTimeout {
+					return nil, err
+				}
+
+				self.logger.Info("retrying-lock-acquisition", Data{"error": err.Error()})
+			} else {
+				failingSince = time.Time{}
+
+				if acquired {
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(self.lockPollInterval):
+			}
+
+			if time.Since(lastHeartbeat) >= self.lockHeartbeatInterval {
+				lastHeartbeat = time.Now()
+				self.logger.Info("still-waiting-for-migration-lock", Data{"waited": time.Since(start).String()})
+			}
+		}
+
+		self.logger.Info("acquired-migration-lock", Data{"waited": time.Since(start).String()})
+	}
+
+	return newLock, err
+}
+
+// lockLogger returns the lager.Logger the lock package requires, which is the
+// migrator's own logger when it is a lager one.
+func (self *migrator) lockLogger() lager.Logger {
+	if logger, ok := self.logger.(*lagerLogger); ok {
+		return logger.logger
+	}
+
+	return lager.NewLogger("migrations")
+}
+
+// ForceUnlock releases the migration lock no matter which session holds it,
+// by terminating the holding sessions. It is intended for recovering from an
+// instance that crashed or hung while migrating, and must not be used while a
+// migration is genuinely in progress. It does nothing for dialects that do not
+// use AdvisoryLock.
+func (self *migrator) ForceUnlock() error {
+	if self.dialect.LockStrategy() != AdvisoryLock {
+		return nil
+	}
+
+	self.logger.Info("force-unlocking-migration-lock", Data{"id": self.lockID})
+
+	query, args, err := advisoryLockHoldersQuery(self.lockID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := self.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var pid int
+		var terminated bool
+		err = rows.Scan(&pid, &terminated)
+		if err != nil {
+			return err
+		}
+
+		self.logger.Info("terminated-session-holding-migration-lock", Data{"pid": pid, "terminated": terminated})
+	}
+
+	return rows.Err()
+}
+
+// advisoryLockHoldersQuery builds a query terminating every other session
+// holding the advisory lock for the given ID, returning their pids and whether
+// they were terminated. IDs with one element are a single bigint key and IDs
+// with two are a pair of int keys, matching how the lock package acquires
+// them.
+//
+// Postgres may evaluate the quals of a WHERE clause in any order, so
+// pg_terminate_backend must not be one of them: the holders are selected in a
+// subquery that OFFSET 0 keeps from being flattened into the outer query, and
+// only the outer select list terminates them.
+func advisoryLockHoldersQuery(id lock.LockID) (string, []interface{}, error) {
+	const terminate = "SELECT pid, pg_terminate_backend(pid) FROM (SELECT DISTINCT pid FROM pg_locks WHERE locktype = 'advisory' AND granted AND pid != pg_backend_pid() AND %s OFFSET 0) AS holders"
+
+	switch len(id) {
+	case 1:
+		return fmt.Sprintf(terminate, "objsubid = 1 AND ((classid::bigint << 32) | objid::bigint) = $1"), []interface{}{id[0]}, nil
+	case 2:
+		return fmt.Sprintf(terminate, "objsubid = 2 AND classid = $1 AND objid = $2"), []interface{}{id[0], id[1]}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported lock id: %v", id)
+	}
+}
+
+// IsFreshDatabase reports whether the database has never been migrated, i.e.
+// it has neither a migrations_history table nor the version table of a
+// previous migrator.
+func (self *migrator) IsFreshDatabase() (bool, error) {
+	tables := []string{"migrations_history"}
+	if self.dialect.HasLegacyTables() {
+		tables = append(tables, "schema_migrations", "migration_version")
+	}
+
+	for _, table := range tables {
+		exists, err := self.checkVersionTableExists(table)
+		if err != nil {
+			return false, err
+		}
+
+		if exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (self *migrator) tableExists(tableName string) bool {
+	return tableExists(self.db, self.dialect, tableName)
+}
+
+// versionTable qualifies the name of a version table with the schema given to
+// WithSchema, if any.
+func (self *migrator) versionTable(tableName string) string {
+	if self.schema == "" {
+		return tableName
+	}
+
+	return pq.QuoteIdentifier(self.schema) + "." + tableName
+}
+
+// versionTableExists is tableExists for version tables, which are only looked
+// for in the schema given to WithSchema, if any.
+func (self *migrator) versionTableExists(tableName string) bool {
+	exists, err := self.checkVersionTableExists(tableName)
+	return err != nil || exists
+}
+
+func (self *migrator) checkVersionTableExists(tableName string) (bool, error) {
+	var exists bool
+
+	if self.schema == "" {
+		err := self.db.QueryRow(self.dialect.TableExistsQuery(), tableName).Scan(&exists)
+		return exists, err
+	}
+
+	err := self.db.QueryRow("SELECT EXISTS ( SELECT 1 FROM information_schema.tables WHERE table_schema=$1 AND table_name=$2)", self.schema, tableName).Scan(&exists)
+	return exists, err
+}
+
+func tableExists(db *sql.DB, dialect Dialect, tableName string) bool {
+	var exists bool
+	err := db.QueryRow(dialect.TableExistsQuery(), tableName).Scan(&exists)
+	return err != nil || exists
+}
+
+// migrateFromSchemaMigrations returns the version recorded by the legacy
+// schema_migrations table, if migrations_history has yet to take over, along
+// with the version it was left dirty at if that is being resumed.
+func (self *migrator) migrateFromSchemaMigrations() (int, int, error) {
+	if !self.dialect.HasLegacyTables() {
+		return 0, 0, nil
+	}
+
+	if !self.versionTableExists("schema_migrations") {
+		return 0, 0, nil
+	}
+
+	recorded, err := self.historyRecorded()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if recorded {
+		return 0, 0, nil
+	}
+
+	var isDirty = false
+	var existingVersion int
+	err = self.db.QueryRow("SELECT dirty, version FROM "+self.versionTable("schema_migrations")+" LIMIT 1").Scan(&isDirty, &existingVersion)
+	if err == sql.ErrNoRows {
+		return 0, 0, self.checkNoApplicationTables()
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if isDirty {
+		if !self.autoResumeDirty {
+			return 0, 0, errors.New("cannot begin migration. Database is in a dirty state")
+		}
+
+		previous, err := self.resumeDirtyLegacyVersion(existingVersion)
+		return previous, existingVersion, err
+	}
+
+	return existingVersion, 0, nil
+}
+
+// resumeDirtyLegacyVersion returns the version to start from for a
+// schema_migrations table left dirty at version, which is the version before
+// it, so that it is attempted again.
+func (self *migrator) resumeDirtyLegacyVersion(version int) (int, error) {
+	previous := 0
+	found := false
+	for _, supported := range self.supportedVersions {
+		if supported == version {
+			found = true
+			break
+		}
+
+		previous = supported
+	}
+
+	if !found {
+		return 0, fmt.Errorf("cannot resume the dirty version %d, which has no migration", version)
+	}
+
+	self.logger.Info("resuming-dirty-version", Data{"version": version, "from": previous})
+
+	return previous, nil
+}
+
+// checkNoApplicationTables fails if the schema has tables other than the
+// migrator's own, for when no version is recorded anywhere. Migrating such a
+// database from scratch would replay migrations whose tables already exist.
+func (self *migrator) checkNoApplicationTables() error {
+	schema := "current_schema()"
+	args := []interface{}{}
+	if self.schema != "" {
+		schema = "$1"
+		args = append(args, self.schema)
+	}
+
+	var table string
+	err := self.db.QueryRow(`
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema = `+schema+`
+		AND table_type = 'BASE TABLE'
+		AND table_name NOT IN ('migrations_history', 'schema_migrations', 'migration_version', 'migration_timings', 'migration_state', 'migration_progress')
+		ORDER BY table_name
+		LIMIT 1
+	`, args...).Scan(&table)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return err
 	}
 
-	return existingVersion, nil
+	return &UnknownSchemaVersionError{Table: table}
 }
 
 type filenames []string
@@ -421,22 +3320,22 @@ func sortMigrations(migrationList []migration) {
 func (self *migrator) migrateToSchemaMigrations(toVersion int) error {
 	newMigrationsHistoryFirstVersion := 1532706545
 
-	if toVersion >= newMigrationsHistoryFirstVersion {
+	if toVersion >= newMigrationsHistoryFirstVersion || !self.dialect.HasLegacyTables() {
 		return nil
 	}
 
-	if !checkTableExist(self.db, "schema_migrations") {
-		_, err := self.db.Exec("CREATE TABLE schema_migrations (version bigint, dirty boolean)")
+	if !self.versionTableExists("schema_migrations") {
+		_, err := self.db.Exec("CREATE TABLE " + self.versionTable("schema_migrations") + " (version bigint, dirty boolean)")
 		if err != nil {
 			return err
 		}
 
-		_, err = self.db.Exec("INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", toVersion)
+		_, err = self.db.Exec("INSERT INTO "+self.versionTable("schema_migrations")+" (version, dirty) VALUES ($1, false)", toVersion)
 		if err != nil {
 			return err
 		}
 	} else {
-		_, err := self.db.Exec("UPDATE schema_migrations SET version=$1, dirty=false", toVersion)
+		_, err := self.db.Exec("UPDATE "+self.versionTable("schema_migrations")+" SET version=$1, dirty=false", toVersion)
 		if err != nil {
 			return err
 		}
@@ -1,16 +1,23 @@
 package migration_test
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"math/rand"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/concourse/atc/db/encryption"
 	"github.com/concourse/atc/db/lock"
+	"github.com/concourse/atc/db/lock/lockfakes"
 	"github.com/concourse/atc/db/migration"
 	"github.com/concourse/atc/db/migration/migrationfakes"
 	"github.com/lib/pq"
@@ -88,6 +95,47 @@ var _ = Describe("Migration", func() {
 			Expect(version).To(Equal(myDatabaseVersion))
 		})
 
+		It("CurrentVersionContext reads the version through the given read-only connection", func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+			})
+
+			SetupMigrationsHistoryTableToExistAtVersion(db, initialSchemaVersion)
+
+			replica, err := sql.Open("postgres", postgresRunner.DataSourceName()+" default_transaction_read_only=on")
+			Expect(err).NotTo(HaveOccurred())
+			defer replica.Close()
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err = db.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			version, err := migrator.CurrentVersionContext(context.Background(), replica)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(initialSchemaVersion))
+		})
+
+		It("CurrentVersionName reports the current version and the name of its migration", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql": `CREATE TABLE first_table (id integer);`,
+				"2000_add_pipelines.up.sql.tmpl": `CREATE TABLE pipelines (id integer);`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			version, name, err := migrator.CurrentVersionName()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(0))
+			Expect(name).To(BeEmpty())
+
+			Expect(migrator.Up()).To(Succeed())
+
+			version, name, err = migrator.CurrentVersionName()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(2000))
+			Expect(name).To(Equal("add_pipelines"))
+		})
+
 		It("SupportedVersion reports the highest supported migration version", func() {
 
 			SetupMigrationsHistoryTableToExistAtVersion(db, initialSchemaVersion)
@@ -106,6 +154,25 @@ var _ = Describe("Migration", func() {
 			Expect(version).To(Equal(2000000000))
 		})
 
+		It("SupportedVersions reports every supported version in ascending order", func() {
+			bindata.AssetNamesReturns([]string{
+				"2000000000_latest_migration.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+				"1510262030_initial_schema.up.sql",
+				"300000_this_is_to_prove_we_dont_use_string_sort.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+				"migrations.go",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.SupportedVersions()).To(Equal([]int{
+				300000,
+				1510262030,
+				1510670987,
+				2000000000,
+			}))
+		})
+
 		It("Ignores files it can't parse", func() {
 
 			SetupMigrationsHistoryTableToExistAtVersion(db, initialSchemaVersion)
@@ -126,6 +193,50 @@ var _ = Describe("Migration", func() {
 		})
 	})
 
+	Context("MigrationSetChecksum", func() {
+		var assets map[string]string
+
+		checksum := func() string {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, NewMapBindata(assets))
+
+			sum, err := migrator.MigrationSetChecksum()
+			Expect(err).NotTo(HaveOccurred())
+			return sum
+		}
+
+		BeforeEach(func() {
+			assets = map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":  `CREATE TABLE second_table (id integer);`,
+			}
+		})
+
+		It("is stable for the same migrations", func() {
+			first := checksum()
+			Expect(first).To(MatchRegexp("^[0-9a-f]{64}$"))
+
+			for i := 0; i < 5; i++ {
+				Expect(checksum()).To(Equal(first))
+			}
+		})
+
+		It("changes when a migration changes", func() {
+			before := checksum()
+
+			assets["2000_create_second_table.up.sql"] = `CREATE TABLE second_table (id bigint);`
+			Expect(checksum()).NotTo(Equal(before))
+		})
+
+		It("changes when a migration is renamed", func() {
+			before := checksum()
+
+			assets["2000_create_other_table.up.sql"] = assets["2000_create_second_table.up.sql"]
+			delete(assets, "2000_create_second_table.up.sql")
+			Expect(checksum()).NotTo(Equal(before))
+		})
+	})
+
 	Context("Upgrade", func() {
 		Context("old schema_migrations table exist", func() {
 			var dirty bool
@@ -257,7 +368,7 @@ var _ = Describe("Migration", func() {
 
 				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 				err := migrator.Up()
-				Expect(err).NotTo(HaveOccurred())
+				Expect(err).To(Equal(migration.ErrNoChange))
 
 				By("Not creating the database referenced in the migration")
 				var exists string
@@ -298,6 +409,47 @@ var _ = Describe("Migration", func() {
 
 			})
 
+			It("renders template migrations with the supplied data", func() {
+				bindata.AssetNamesReturns([]string{
+					"1000_seed_table.up.sql.tmpl",
+				})
+				bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_table (name varchar);
+						INSERT INTO some_table (name) VALUES ('{{ .TeamName }}');
+						COMMIT;
+						`), nil)
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithTemplateData(map[string]string{"TeamName": "some-team"}),
+				)
+
+				migrations, err := migrator.Migrations()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(migrations[0].Statements[1].SQL).To(ContainSubstring("'some-team'"))
+
+				err = migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+
+				var name string
+				err = db.QueryRow("SELECT name FROM some_table").Scan(&name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(name).To(Equal("some-team"))
+			})
+
+			It("fails to render a template migration missing a value", func() {
+				bindata.AssetNamesReturns([]string{
+					"1000_seed_table.up.sql.tmpl",
+				})
+				bindata.AssetReturns([]byte(`INSERT INTO some_table (name) VALUES ('{{ .TeamName }}');`), nil)
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				_, err := migrator.Migrations()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("1000_seed_table.up.sql.tmpl"))
+			})
+
 			Context("With a transactional migration", func() {
 				It("leaves the database clean after a failure", func() {
 					bindata.AssetNamesReturns([]string{
@@ -312,181 +464,2797 @@ var _ = Describe("Migration", func() {
 					ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
 					ExpectMigrationToHaveFailed(db, 1525724789, false)
 				})
-			})
-
-			Context("With a non-transactional migration", func() {
-				It("fails if the migration version is in a dirty state", func() {
-					dirtyMigrationFilename := "1510262031_dirty_migration.up.sql"
-					bindata.AssetStub = func(name string) ([]byte, error) {
-						if name == dirtyMigrationFilename {
-							return []byte(`
-							-- NO_TRANSACTION
-							DROP TABLE nonexistent;
-						`), nil
-						}
-						return asset(name)
-					}
 
+				It("runs the migration with the driver's default isolation level", func() {
 					bindata.AssetNamesReturns([]string{
-						dirtyMigrationFilename,
+						"1000_record_isolation.up.sql",
 					})
+					bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE isolation (level varchar);
+						INSERT INTO isolation (level) SELECT current_setting('transaction_isolation');
+						COMMIT;
+						`), nil)
 
 					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 
 					err := migrator.Up()
-					Expect(err).To(HaveOccurred())
-					Expect(err.Error()).To(MatchRegexp("Migration.*failed"))
-
-					ExpectMigrationToHaveFailed(db, 1510262031, true)
-				})
-			})
+					Expect(err).NotTo(HaveOccurred())
 
-			It("Doesn't fail if there are no migrations to run", func() {
-				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
+					var level string
+					err = db.QueryRow("SELECT level FROM isolation").Scan(&level)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(level).To(Equal("read committed"))
 				})
 
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
-				err := migrator.Up()
-				Expect(err).NotTo(HaveOccurred())
+				It("runs the migration with the requested isolation level", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_record_isolation.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE isolation (level varchar);
+						INSERT INTO isolation (level) SELECT current_setting('transaction_isolation');
+						COMMIT;
+						`), nil)
 
-				err = migrator.Up()
-				Expect(err).NotTo(HaveOccurred())
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithIsolationLevel(sql.LevelSerializable),
+					)
 
-				ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
+					err := migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
 
-				ExpectMigrationVersionTableNotToExist(db)
+					var level string
+					err = db.QueryRow("SELECT level FROM isolation").Scan(&level)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(level).To(Equal("serializable"))
+				})
 
-				ExpectToBeAbleToInsertData(db)
-			})
+				It("runs only the migrations for Postgres, recording the others as applied", func() {
+					logger := &recordingLogger{}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, NewMapBindata(dialectSpecificMigrations),
+						migration.WithLogger(logger),
+					)
 
-			It("Locks the database so multiple ATCs don't all run migrations at the same time", func() {
-				SetupMigrationsHistoryTableToExistAtVersion(db, 1510262030)
+					err := migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
 
-				SetupSchemaFromFile(db, "migrations/1510262030_initial_schema.up.sql")
+					ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+					Expect(logger.Logs("skipping-migration-for-other-dialect")).To(HaveLen(1))
+					ExpectTableExistenceToEqual(db, "team_names", false)
 
-				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
+					var comment string
+					err = db.QueryRow("SELECT obj_description('teams'::regclass)").Scan(&comment)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(comment).To(Equal("teams"))
 				})
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 
-				var wg sync.WaitGroup
-				wg.Add(3)
+				It("does not leak session settings between files with a connection per migration", func() {
+					bindata = NewMapBindata(map[string]string{
+						"1000_set_timeout.up.sql": `
+							SET statement_timeout = '1234ms';
+							CREATE TABLE first_table (id integer);
+						`,
+						"2000_record_timeout.up.sql": `
+							CREATE TABLE settings AS SELECT current_setting('statement_timeout') AS timeout;
+						`,
+					})
 
-				go TryRunUpAndVerifyResult(db, migrator, &wg)
-				go TryRunUpAndVerifyResult(db, migrator, &wg)
-				go TryRunUpAndVerifyResult(db, migrator, &wg)
+					// with a single connection, a leaked setting would be seen by
+					// every later file
+					db.SetMaxOpenConns(1)
 
-				wg.Wait()
-			})
-		})
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithConnectionPerMigration(),
+					)
 
-		Context("golang migrations", func() {
-			It("runs a migration with Migrate", func() {
+					err := migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
 
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
-				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
-					"1516643303_update_auth_providers.up.go",
+					var timeout string
+					err = db.QueryRow("SELECT timeout FROM settings").Scan(&timeout)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(timeout).To(Equal("0"))
 				})
 
-				By("applying the initial migration")
-				err := migrator.Migrate(1510262030)
-				var columnExists string
-				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(columnExists).To(Equal("true"))
+				It("reports the line of the statement that failed", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_broken_migration.up.sql",
+					})
+					bindata.AssetReturns([]byte(`BEGIN;
+  CREATE TABLE some_table (id integer);
 
-				err = migrator.Migrate(1516643303)
-				Expect(err).NotTo(HaveOccurred())
+  DROP TABLE nonexistent;
+COMMIT;
+`), nil)
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 
-				By("applying the go migration")
-				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(columnExists).To(Equal("false"))
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed at line 4"))
 
-				By("updating the schema migrations table")
-				ExpectDatabaseMigrationVersionToEqual(migrator, 1516643303)
+					migrationErr, ok := err.(*migration.MigrationError)
+					Expect(ok).To(BeTrue())
+					Expect(migrationErr.Version).To(Equal(1000))
+					Expect(migrationErr.Statement.SQL).To(Equal("DROP TABLE nonexistent"))
+				})
 			})
 
-			It("runs a migration with Up", func() {
+			It("executes statements rewritten by the statement transform", func() {
+				_, err := db.Exec("CREATE SCHEMA tenant")
+				Expect(err).NotTo(HaveOccurred())
 
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
-					"1516643303_update_auth_providers.up.go",
+					"1000_test_table_created.up.sql",
 				})
+				bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_table (id integer);
+						INSERT INTO some_table (id) VALUES (1);
+						COMMIT;
+						`), nil)
 
-				err := migrator.Up()
+				executed := []string{}
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithStatementTransform(func(statement string) (string, error) {
+						statement = strings.Replace(statement, "some_table", "tenant.some_table", -1)
+						executed = append(executed, statement)
+						return statement, nil
+					}),
+				)
+
+				err = migrator.Up()
 				Expect(err).NotTo(HaveOccurred())
 
-				By("applying the migration")
-				var columnExists string
-				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
+				Expect(executed).To(Equal([]string{
+					"CREATE TABLE tenant.some_table (id integer)",
+					"INSERT INTO tenant.some_table (id) VALUES (1)",
+				}))
+
+				var count int
+				err = db.QueryRow("SELECT COUNT(*) FROM tenant.some_table").Scan(&count)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(columnExists).To(Equal("false"))
+				Expect(count).To(Equal(1))
 
-				By("updating the schema migrations table")
-				ExpectDatabaseMigrationVersionToEqual(migrator, 1516643303)
+				var exists bool
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = 'some_table' AND table_schema = 'public')").Scan(&exists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
 			})
-		})
-	})
 
-	Context("Downgrade", func() {
-		Context("Downgrades to a version that uses the old mattes/migrate schema_migrations table", func() {
-			It("Downgrades to a given version and write it to a new created schema_migrations table", func() {
+			It("skips statements that are empty instead of executing them", func() {
 				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
-					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
-					"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+					"1000_test_table_created.up.sql",
 				})
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+				bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_table (id integer);
+						INSERT INTO some_table (id) VALUES (1);
+						COMMIT;
+						`), nil)
 
-				err := migrator.Up()
-				Expect(err).NotTo(HaveOccurred())
+				logger := &recordingLogger{}
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithLogger(logger),
+					migration.WithStatementTransform(func(statement string) (string, error) {
+						if strings.HasPrefix(statement, "INSERT") {
+							return "  ", nil
+						}
+						return statement, nil
+					}),
+				)
 
-				currentVersion, err := migrator.CurrentVersion()
+				err := migrator.Up()
 				Expect(err).NotTo(HaveOccurred())
-				Expect(currentVersion).To(Equal(upgradedSchemaVersion))
 
-				err = migrator.Migrate(initialSchemaVersion)
-				Expect(err).NotTo(HaveOccurred())
+				Expect(logger.Actions()).To(ContainElement("skipping-empty-statement"))
+				ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
 
-				currentVersion, err = migrator.CurrentVersion()
+				var count int
+				err = db.QueryRow("SELECT COUNT(*) FROM some_table").Scan(&count)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(currentVersion).To(Equal(initialSchemaVersion))
-
-				ExpectDatabaseVersionToEqual(db, initialSchemaVersion, "schema_migrations")
-
-				ExpectToBeAbleToInsertData(db)
+				Expect(count).To(Equal(0))
 			})
 
-			It("Downgrades to a given version and write it to the existing schema_migrations table with dirty true", func() {
-
+			It("logs each statement with secrets redacted when asked to", func() {
 				bindata.AssetNamesReturns([]string{
-					"1510262030_initial_schema.up.sql",
-					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
-					"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+					"1000_seed_users.up.sql",
 				})
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+				bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_users (name varchar, password varchar);
+						INSERT INTO some_users (name, password) VALUES ('admin', 'password:hunter2');
+						COMMIT;
+						`), nil)
+
+				logger := &recordingLogger{}
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithLogger(logger),
+					migration.WithQueryLogging(regexp.MustCompile(`password:\w+`)),
+				)
 
 				err := migrator.Up()
 				Expect(err).NotTo(HaveOccurred())
 
-				currentVersion, err := migrator.CurrentVersion()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(currentVersion).To(Equal(upgradedSchemaVersion))
+				logs := logger.Logs("executing-statement")
+				Expect(logs).To(HaveLen(2))
+				Expect(logs[1].Data["sql"]).To(Equal("INSERT INTO some_users (name, password) VALUES ('admin', '***')"))
+			})
 
-				SetupSchemaMigrationsTable(db, 8878, true)
+			Context("progress logging", func() {
+				BeforeEach(func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_test_table_created.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_table (id integer);
+						INSERT INTO some_table (id) VALUES (1);
+						COMMIT;
+						`), nil)
+				})
 
-				err = migrator.Migrate(initialSchemaVersion)
-				Expect(err).NotTo(HaveOccurred())
+				It("logs the number of statements in each migration", func() {
+					logger := &recordingLogger{}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
 
-				currentVersion, err = migrator.CurrentVersion()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(currentVersion).To(Equal(initialSchemaVersion))
+					err := migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
 
-				ExpectDatabaseVersionToEqual(db, initialSchemaVersion, "schema_migrations")
+					logs := logger.Logs("applying-migration")
+					Expect(logs).To(HaveLen(1))
+					Expect(logs[0].Data).To(Equal(migration.Data{"version": 1000, "direction": "up", "statements": 2}))
+					Expect(logger.Logs("applying-statement")).To(BeEmpty())
+				})
+
+				It("logs each statement when asked to", func() {
+					logger := &recordingLogger{}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithLogger(logger),
+						migration.WithStatementProgress(),
+					)
+
+					err := migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+
+					logs := logger.Logs("applying-statement")
+					Expect(logs).To(HaveLen(2))
+					Expect(logs[0].Data["statement"]).To(Equal("1/2"))
+					Expect(logs[1].Data["statement"]).To(Equal("2/2"))
+				})
+			})
+
+			It("rolls back the migration in progress when the context is cancelled", func() {
+				bindata.AssetNamesReturns([]string{
+					"1000_test_table_created.up.sql",
+				})
+				bindata.AssetReturns([]byte(`
+						BEGIN;
+						CREATE TABLE some_table (id integer);
+						INSERT INTO some_table (id) VALUES (1);
+						COMMIT;
+						`), nil)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithLogger(&cancellingLogger{statement: "2/2", cancel: cancel}),
+					migration.WithStatementProgress(),
+				)
+
+				err := migrator.MigrateContext(ctx, 1000)
+				Expect(err).To(Equal(context.Canceled))
+
+				var exists bool
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = 'some_table')").Scan(&exists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+
+				ExpectMigrationToHaveFailed(db, 1000, false)
+			})
+
+			Context("with a custom error classifier", func() {
+				It("retries a transactional migration whose error is retriable", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_insert_into_missing_table.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+						BEGIN;
+						INSERT INTO missing_table (id) VALUES (1);
+						COMMIT;
+						`), nil)
+
+					logger := &recordingLogger{}
+					classifier := &fakeErrorClassifier{retriable: true}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithLogger(logger),
+						migration.WithErrorClassifier(classifier),
+					)
+
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+
+					Expect(classifier.retriableChecks).To(Equal(2))
+					Expect(logger.Logs("retrying-migration")).To(HaveLen(2))
+					ExpectMigrationToHaveFailed(db, 1000, false)
+				})
+
+				It("reports which NO_TRANSACTION statement failed and marks the version dirty", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_create_tables.up.sql",
+					})
+					bindata.AssetReturns([]byte(`-- NO_TRANSACTION
+CREATE TABLE some_table (id integer);
+DROP TABLE nonexistent;
+CREATE TABLE other_table (id integer);
+`), nil)
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed at line 3 (statement 2)"))
+
+					migrationErr, ok := err.(*migration.MigrationError)
+					Expect(ok).To(BeTrue())
+					Expect(migrationErr.StatementIndex).To(Equal(2))
+					Expect(migrationErr.Statement.SQL).To(Equal("DROP TABLE nonexistent"))
+
+					ExpectMigrationToHaveFailed(db, 1000, true)
+					ExpectTableExistenceToEqual(db, "some_table", true)
+					ExpectTableExistenceToEqual(db, "other_table", false)
+				})
+
+				It("skips NO_TRANSACTION statements whose error is ignorable", func() {
+					_, err := db.Exec("CREATE TABLE some_table (id integer)")
+					Expect(err).NotTo(HaveOccurred())
+
+					bindata.AssetNamesReturns([]string{
+						"1000_create_tables.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE TABLE some_table (id integer);
+							CREATE TABLE other_table (id integer);
+						`), nil)
+
+					classifier := &fakeErrorClassifier{ignorable: true}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithSkipExistingIndexes(),
+						migration.WithErrorClassifier(classifier),
+					)
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+					Expect(classifier.ignorableChecks).To(Equal(1))
+
+					_, err = db.Exec("SELECT id FROM other_table")
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("With an atomic run", func() {
+				var assets map[string]string
+
+				BeforeEach(func() {
+					assets = map[string]string{
+						"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+						"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+						"1001_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+						"1001_create_second_table.down.sql": `DROP TABLE second_table;`,
+						"1002_broken_migration.up.sql":      `DROP TABLE nonexistent;`,
+					}
+
+					bindata.AssetNamesStub = func() []string {
+						names := []string{}
+						for name := range assets {
+							names = append(names, name)
+						}
+						return names
+					}
+					bindata.AssetStub = func(name string) ([]byte, error) {
+						return []byte(assets[name]), nil
+					}
+				})
+
+				It("rolls back to the starting version when a migration fails", func() {
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithAtomicRun())
+
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("rolled back to version 0"))
+
+					ExpectDatabaseMigrationVersionToEqual(migrator, 0)
+
+					var exists bool
+					err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name IN ('first_table', 'second_table'))").Scan(&exists)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+				})
+
+				It("does not roll back past a failed non-transactional migration", func() {
+					assets["1002_broken_migration.up.sql"] = `
+					-- NO_TRANSACTION
+					DROP TABLE nonexistent;`
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithAtomicRun())
+
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("cannot be reversed automatically"))
+
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1001)
+					ExpectMigrationToHaveFailed(db, 1002, true)
+				})
+			})
+
+			It("stops after the migration in progress when signalled", func() {
+				bindata = NewMapBindata(map[string]string{
+					"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+					"1001_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+					"1002_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+				})
+
+				stop := make(chan struct{})
+				signalDuringFirst := func(statement string) (string, error) {
+					if strings.Contains(statement, "first_table") {
+						close(stop)
+					}
+					return statement, nil
+				}
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+					migration.WithStatementTransform(signalDuringFirst),
+					migration.WithStopAfterCurrent(stop),
+				)
+
+				err := migrator.Up()
+				Expect(errors.Is(err, migration.ErrStoppedEarly)).To(BeTrue())
+				Expect(err).To(Equal(&migration.StoppedEarlyError{LastAppliedVersion: 1000, TargetVersion: 1002}))
+
+				ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+				var exists bool
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = 'second_table')").Scan(&exists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+
+			Context("With a non-transactional migration", func() {
+				It("fails if the migration version is in a dirty state", func() {
+					dirtyMigrationFilename := "1510262031_dirty_migration.up.sql"
+					bindata.AssetStub = func(name string) ([]byte, error) {
+						if name == dirtyMigrationFilename {
+							return []byte(`
+							-- NO_TRANSACTION
+							DROP TABLE nonexistent;
+						`), nil
+						}
+						return asset(name)
+					}
+
+					bindata.AssetNamesReturns([]string{
+						dirtyMigrationFilename,
+					})
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+					err := migrator.Up()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(MatchRegexp("Migration.*failed"))
+
+					ExpectMigrationToHaveFailed(db, 1510262031, true)
+				})
+
+				It("drops the invalid index left by a failed concurrent index build before retrying", func() {
+					_, err := db.Exec("CREATE TABLE some_table (id integer)")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = db.Exec("INSERT INTO some_table (id) VALUES (1), (1)")
+					Expect(err).NotTo(HaveOccurred())
+
+					bindata.AssetNamesReturns([]string{
+						"1000_create_unique_index.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE UNIQUE INDEX CONCURRENTLY some_index ON some_table (id);
+						`), nil)
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+					err = migrator.Up()
+					Expect(err).To(HaveOccurred())
+					ExpectMigrationToHaveFailed(db, 1000, true)
+
+					var valid bool
+					err = db.QueryRow("SELECT indisvalid FROM pg_index JOIN pg_class ON pg_class.oid = pg_index.indexrelid WHERE relname = 'some_index'").Scan(&valid)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(valid).To(BeFalse())
+
+					_, err = db.Exec("DELETE FROM some_table WHERE ctid IN (SELECT ctid FROM some_table LIMIT 1)")
+					Expect(err).NotTo(HaveOccurred())
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+					err = db.QueryRow("SELECT indisvalid FROM pg_index JOIN pg_class ON pg_class.oid = pg_index.indexrelid WHERE relname = 'some_index'").Scan(&valid)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(valid).To(BeTrue())
+				})
+
+				It("keeps the valid indexes built by a failed migration when retrying", func() {
+					_, err := db.Exec("CREATE TABLE some_table (id integer, name text)")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = db.Exec("INSERT INTO some_table (id, name) VALUES (1, 'a'), (1, 'b')")
+					Expect(err).NotTo(HaveOccurred())
+
+					bindata.AssetNamesReturns([]string{
+						"1000_create_indexes.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE INDEX CONCURRENTLY IF NOT EXISTS valid_index ON some_table (name);
+							CREATE UNIQUE INDEX CONCURRENTLY invalid_index ON some_table (id);
+						`), nil)
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+					err = migrator.Up()
+					Expect(err).To(HaveOccurred())
+					ExpectMigrationToHaveFailed(db, 1000, true)
+
+					indexOID := func(name string) (oid int, valid bool) {
+						err := db.QueryRow("SELECT pg_class.oid, indisvalid FROM pg_index JOIN pg_class ON pg_class.oid = pg_index.indexrelid WHERE relname = $1", name).Scan(&oid, &valid)
+						Expect(err).NotTo(HaveOccurred())
+						return oid, valid
+					}
+
+					validOID, valid := indexOID("valid_index")
+					Expect(valid).To(BeTrue())
+
+					_, valid = indexOID("invalid_index")
+					Expect(valid).To(BeFalse())
+
+					_, err = db.Exec("DELETE FROM some_table WHERE name = 'b'")
+					Expect(err).NotTo(HaveOccurred())
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+					oid, valid := indexOID("valid_index")
+					Expect(valid).To(BeTrue())
+					Expect(oid).To(Equal(validOID))
+
+					_, valid = indexOID("invalid_index")
+					Expect(valid).To(BeTrue())
+				})
+
+				It("resumes a migration that left the database dirty after its last completed statement with WithAutoResumeDirty", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_create_resumed_table.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE TABLE resumed_table (id integer);
+							INSERT INTO resumed_table (id) VALUES (1);
+							DROP TABLE missing_table;
+						`), nil)
+
+					err := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Up()
+					Expect(err).To(HaveOccurred())
+					ExpectMigrationToHaveFailed(db, 1000, true)
+
+					_, err = db.Exec("CREATE TABLE missing_table (id integer)")
+					Expect(err).NotTo(HaveOccurred())
+
+					logger := &recordingLogger{}
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithAutoResumeDirty(), migration.WithLogger(logger))
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+					ExpectTableExistenceToEqual(db, "missing_table", false)
+
+					Expect(logger.Logs("skipping-completed-statement")).To(HaveLen(2))
+
+					var rows int
+					err = db.QueryRow("SELECT COUNT(*) FROM resumed_table").Scan(&rows)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(rows).To(Equal(1))
+				})
+
+				It("re-runs a dirty migration from its first statement without WithAutoResumeDirty", func() {
+					bindata.AssetNamesReturns([]string{
+						"1000_create_resumed_table.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE TABLE resumed_table (id integer);
+							DROP TABLE missing_table;
+						`), nil)
+
+					err := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Up()
+					Expect(err).To(HaveOccurred())
+
+					_, err = db.Exec("CREATE TABLE missing_table (id integer)")
+					Expect(err).NotTo(HaveOccurred())
+
+					err = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Up()
+					Expect(err).To(MatchError(ContainSubstring("already exists")))
+				})
+
+				It("runs every statement on the same connection", func() {
+					_, err := db.Exec("CREATE TABLE backend_pids (pid integer)")
+					Expect(err).NotTo(HaveOccurred())
+
+					bindata.AssetNamesReturns([]string{
+						"1000_record_backend_pids.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							INSERT INTO backend_pids (pid) SELECT pg_backend_pid();
+							INSERT INTO backend_pids (pid) SELECT pg_backend_pid();
+							INSERT INTO backend_pids (pid) SELECT pg_backend_pid();
+						`), nil)
+
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithSkipExistingIndexes())
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+
+					var rows, pids int
+					err = db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT pid) FROM backend_pids").Scan(&rows, &pids)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(rows).To(Equal(3))
+					Expect(pids).To(Equal(1))
+				})
+
+				It("skips building an index that already exists when asked to", func() {
+					_, err := db.Exec("CREATE TABLE some_table (id integer, name varchar)")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = db.Exec("CREATE INDEX some_id_index ON some_table (id)")
+					Expect(err).NotTo(HaveOccurred())
+
+					bindata.AssetNamesReturns([]string{
+						"1000_create_indexes.up.sql",
+					})
+					bindata.AssetReturns([]byte(`
+							-- NO_TRANSACTION
+							CREATE INDEX CONCURRENTLY some_id_index ON some_table (id);
+							CREATE INDEX CONCURRENTLY some_name_index ON some_table (name);
+						`), nil)
+
+					logger := lagertest.NewTestLogger("migrations-test")
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+						migration.WithLogger(migration.NewLagerLogger(logger)),
+						migration.WithSkipExistingIndexes(),
+					)
+
+					err = migrator.Up()
+					Expect(err).NotTo(HaveOccurred())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+					Expect(logger.LogMessages()).To(ContainElement("migrations-test.skipping-existing-index"))
+
+					var valid bool
+					err = db.QueryRow("SELECT indisvalid FROM pg_index JOIN pg_class ON pg_class.oid = pg_index.indexrelid WHERE relname = 'some_name_index'").Scan(&valid)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(valid).To(BeTrue())
+				})
+
+				Context("after a run was interrupted before recording a migration", func() {
+					var migrator migration.Migrator
+
+					BeforeEach(func() {
+						bindata = NewMapBindata(map[string]string{
+							"1000_create_table.up.sql":   `CREATE TABLE some_table (id integer);`,
+							"1000_create_table.down.sql": `DROP TABLE some_table;`,
+							"2000_create_index.up.sql": `-- NO_TRANSACTION
+CREATE INDEX CONCURRENTLY some_id_index ON some_table (id);`,
+							"2000_create_index.down.sql": `DROP INDEX some_id_index;`,
+						})
+						migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+						Expect(migrator.Migrate(1000)).To(Succeed())
+
+						// the interrupted run applied 2000 but died before
+						// recording it or clearing migration_state
+						_, err := db.Exec("CREATE INDEX CONCURRENTLY some_id_index ON some_table (id)")
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("skips the objects that exist and records the version", func() {
+						_, err := db.Exec("INSERT INTO migration_state (started_at) VALUES (now())")
+						Expect(err).NotTo(HaveOccurred())
+
+						logger := &recordingLogger{}
+						migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+						Expect(migrator.Up()).To(Succeed())
+						ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+
+						Expect(logger.Logs("recovering-interrupted-run")).To(HaveLen(1))
+						Expect(logger.Logs("skipping-existing-index")).To(HaveLen(1))
+					})
+
+					It("does not skip existing objects when no run was interrupted", func() {
+						Expect(migrator.Up()).To(MatchError(ContainSubstring("already exists")))
+					})
+				})
+			})
+
+			Context("with a custom no-transaction sentinel", func() {
+				BeforeEach(func() {
+					bindata = NewMapBindata(map[string]string{
+						"1000_create_table.up.sql": `CREATE TABLE some_table (id integer);`,
+						"2000_create_index.up.sql": `-- +migrate notransaction
+CREATE INDEX CONCURRENTLY some_id_index ON some_table (id);`,
+					})
+				})
+
+				It("runs migrations starting with the sentinel outside a transaction", func() {
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithNoTransactionSentinel("-- +migrate notransaction"))
+
+					Expect(migrator.Up()).To(Succeed())
+					ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+				})
+
+				It("runs them in a transaction without the option", func() {
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+					Expect(migrator.Up()).To(MatchError(ContainSubstring("cannot run inside a transaction block")))
+				})
+
+				It("refuses to migrate with an empty sentinel", func() {
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithNoTransactionSentinel(" "))
+
+					Expect(migrator.Up()).To(MatchError(`no-transaction sentinel " " is not a SQL comment starting with --`))
+					ExpectTableExistenceToEqual(db, "some_table", false)
+				})
+
+				It("refuses to migrate with a sentinel that is not a comment", func() {
+					migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithNoTransactionSentinel("NO_TRANSACTION;"))
+
+					Expect(migrator.Up()).To(MatchError(ContainSubstring("is not a SQL comment")))
+					ExpectTableExistenceToEqual(db, "some_table", false)
+				})
+			})
+
+			It("fails if there are no migrations at all", func() {
+				bindata.AssetNamesReturns([]string{})
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				err := migrator.Up()
+				Expect(err).To(Equal(migration.ErrNoMigrations))
+
+				err = migrator.Migrate(1000)
+				Expect(err).To(Equal(migration.ErrNoMigrations))
+			})
+
+			It("allows running without any migrations when asked to", func() {
+				bindata.AssetNamesReturns([]string{})
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithAllowEmpty())
+
+				err := migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns ErrNoChange if there are no migrations to run", func() {
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+				})
+
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+				err := migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+
+				err = migrator.Up()
+				Expect(err).To(Equal(migration.ErrNoChange))
+
+				ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
+
+				ExpectMigrationVersionTableNotToExist(db)
+
+				ExpectToBeAbleToInsertData(db)
+			})
+
+			It("Locks the database so multiple ATCs don't all run migrations at the same time", func() {
+				SetupMigrationsHistoryTableToExistAtVersion(db, 1510262030)
+
+				SetupSchemaFromFile(db, "migrations/1510262030_initial_schema.up.sql")
+
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				var wg sync.WaitGroup
+				wg.Add(3)
+
+				go TryRunUpAndVerifyResult(db, migrator, &wg)
+				go TryRunUpAndVerifyResult(db, migrator, &wg)
+				go TryRunUpAndVerifyResult(db, migrator, &wg)
+
+				wg.Wait()
+			})
+		})
+
+		Context("golang migrations", func() {
+			It("runs a migration with Migrate", func() {
+
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+					"1516643303_update_auth_providers.up.go",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				By("applying the initial migration")
+				err := migrator.Migrate(1510262030)
+				var columnExists string
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(columnExists).To(Equal("true"))
+
+				err = migrator.Migrate(1516643303)
+				Expect(err).NotTo(HaveOccurred())
+
+				By("applying the go migration")
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(columnExists).To(Equal("false"))
+
+				By("updating the schema migrations table")
+				ExpectDatabaseMigrationVersionToEqual(migrator, 1516643303)
+			})
+
+			It("runs a migration with Up", func() {
+
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+					"1516643303_update_auth_providers.up.go",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				err := migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+
+				By("applying the migration")
+				var columnExists string
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns where table_name = 'teams' AND column_name='basic_auth')").Scan(&columnExists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(columnExists).To(Equal("false"))
+
+				By("updating the schema migrations table")
+				ExpectDatabaseMigrationVersionToEqual(migrator, 1516643303)
+			})
+
+			It("runs every migration up to the supported version with UpToSupported", func() {
+
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+					"1516643303_update_auth_providers.up.go",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				err := migrator.UpToSupported()
+				Expect(err).NotTo(HaveOccurred())
+
+				supportedVersion, err := migrator.SupportedVersion()
+				Expect(err).NotTo(HaveOccurred())
+
+				currentVersion, err := migrator.CurrentVersion()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentVersion).To(Equal(supportedVersion))
+			})
+		})
+	})
+
+	Context("ownership check", func() {
+		var logger *lagertest.TestLogger
+
+		BeforeEach(func() {
+			logger = lagertest.NewTestLogger("migrations-test")
+
+			bindata.AssetNamesReturns([]string{
+				"1000_alter_table.up.sql",
+			})
+			bindata.AssetReturns([]byte(`ALTER TABLE some_table ADD COLUMN notes varchar;`), nil)
+
+			_, err := db.Exec("CREATE TABLE some_table (id integer)")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("warns when the migrating role does not own the tables", func() {
+			_, err := db.Exec(`DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'migration_table_owner') THEN CREATE ROLE migration_table_owner; END IF; END $$`)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = db.Exec("ALTER TABLE some_table OWNER TO migration_table_owner")
+			Expect(err).NotTo(HaveOccurred())
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLogger(migration.NewLagerLogger(logger)),
+				migration.WithOwnershipCheck(),
+			)
+
+			err = migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger.LogMessages()).To(ContainElement("migrations-test.role-does-not-own-tables"))
+		})
+
+		It("does not warn when the migrating role owns the tables", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLogger(migration.NewLagerLogger(logger)),
+				migration.WithOwnershipCheck(),
+			)
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger.LogMessages()).NotTo(ContainElement("migrations-test.role-does-not-own-tables"))
+		})
+	})
+
+	Context("Healthcheck", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("reports a fully migrated database as healthy", func() {
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			report, err := migrator.Healthcheck()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.CurrentVersion).To(Equal(upgradedSchemaVersion))
+			Expect(report.SupportedVersion).To(Equal(upgradedSchemaVersion))
+			Expect(report.Pending).To(BeFalse())
+			Expect(report.Dirty).To(BeFalse())
+			Expect(report.CheckedAt).NotTo(BeZero())
+		})
+
+		It("reports pending migrations", func() {
+			err := migrator.Migrate(initialSchemaVersion)
+			Expect(err).NotTo(HaveOccurred())
+
+			report, err := migrator.Healthcheck()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.CurrentVersion).To(Equal(initialSchemaVersion))
+			Expect(report.SupportedVersion).To(Equal(upgradedSchemaVersion))
+			Expect(report.Pending).To(BeTrue())
+			Expect(report.Dirty).To(BeFalse())
+		})
+
+		It("reports pending migrations on a fresh database", func() {
+			report, err := migrator.Healthcheck()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.CurrentVersion).To(Equal(0))
+			Expect(report.Pending).To(BeTrue())
+		})
+
+		It("reports a dirty database", func() {
+			bindata.AssetNamesReturns([]string{
+				"1000_dirty_migration.up.sql",
+			})
+			bindata.AssetReturns([]byte(`
+				-- NO_TRANSACTION
+				DROP TABLE nonexistent;
+			`), nil)
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).To(HaveOccurred())
+
+			report, err := migrator.Healthcheck()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.CurrentVersion).To(Equal(0))
+			Expect(report.Pending).To(BeTrue())
+			Expect(report.Dirty).To(BeTrue())
+		})
+	})
+
+	Context("CurrentVersionDirty", func() {
+		It("reads the version and dirty flag in a single query", func() {
+			fakeDB.Reset()
+
+			fakeConn, err := sql.Open(fakeDriverName, "some-dsn")
+			Expect(err).NotTo(HaveOccurred())
+			defer fakeConn.Close()
+
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(fakeConn, nil, strategy, bindata)
+
+			fakeDB.ReturnRow(migration.CurrentVersionDirtyQuery(migrator), int64(upgradedSchemaVersion), "up", true)
+
+			version, dirty, err := migrator.CurrentVersionDirty()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(upgradedSchemaVersion))
+			Expect(dirty).To(BeTrue())
+
+			Expect(fakeDB.Queries()).To(HaveLen(1))
+		})
+
+		It("reads the version before a reverted one", func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Migrate(upgradedSchemaVersion)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Migrate(initialSchemaVersion)
+			Expect(err).NotTo(HaveOccurred())
+
+			version, dirty, err := migrator.CurrentVersionDirty()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(initialSchemaVersion))
+			Expect(dirty).To(BeFalse())
+		})
+	})
+
+	Context("CompactHistory", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Migrate(initialSchemaVersion)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectMigrationsHistoryRowCountToEqual(db, 4)
+		})
+
+		It("keeps only the most recent rows", func() {
+			err := migrator.CompactHistory(2)
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectMigrationsHistoryRowCountToEqual(db, 2)
+			ExpectDatabaseMigrationVersionToEqual(migrator, upgradedSchemaVersion)
+		})
+
+		It("logs through the configured Logger", func() {
+			logger := &recordingLogger{}
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			err := migrator.CompactHistory(2)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logger.Actions()).To(ContainElement("compacted-history"))
+		})
+
+		It("always keeps the row recording the current version", func() {
+			_, err := db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES (2000000000, current_timestamp + interval '1 minute', 'up', 'failed', false)")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.CompactHistory(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectMigrationsHistoryRowCountToEqual(db, 2)
+			ExpectDatabaseMigrationVersionToEqual(migrator, upgradedSchemaVersion)
+		})
+	})
+
+	Context("Timings", func() {
+		It("records how long each run of a migration took", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migrator.Migrate(0)).To(Succeed())
+			Expect(migrator.Up()).To(Succeed())
+
+			timings, err := migrator.Timings(1000)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(timings).To(HaveLen(3))
+
+			Expect(timings[0].Direction).To(Equal("up"))
+			Expect(timings[1].Direction).To(Equal("down"))
+			Expect(timings[2].Direction).To(Equal("up"))
+
+			for _, timing := range timings {
+				Expect(timing.Version).To(Equal(1000))
+				Expect(timing.Duration).To(BeNumerically(">=", 0))
+				Expect(timing.AppliedAt).NotTo(BeZero())
+			}
+		})
+
+		It("reports no timings before the first migration", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			timings, err := migrator.Timings(1000)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(timings).To(BeEmpty())
+		})
+	})
+
+	Context("ExportVersionTable", func() {
+		It("exports the history as JSON, newest first", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.Migrate(1000)).To(Succeed())
+			Expect(migrator.Migrate(2000)).To(Succeed())
+
+			exported, err := migrator.ExportVersionTable()
+			Expect(err).NotTo(HaveOccurred())
+
+			var rows []map[string]interface{}
+			Expect(json.Unmarshal(exported, &rows)).To(Succeed())
+			Expect(rows).To(HaveLen(2))
+
+			Expect(rows[0]).To(HaveLen(6))
+			Expect(rows[0]).To(HaveKeyWithValue("version", BeNumerically("==", 2000)))
+			Expect(rows[0]).To(HaveKeyWithValue("name", "2000_create_second_table.up.sql"))
+			Expect(rows[0]).To(HaveKeyWithValue("direction", "up"))
+			Expect(rows[0]).To(HaveKeyWithValue("status", "passed"))
+			Expect(rows[0]).To(HaveKeyWithValue("dirty", false))
+			Expect(rows[0]).To(HaveKey("applied_at"))
+
+			Expect(rows[1]).To(HaveKeyWithValue("version", BeNumerically("==", 1000)))
+			Expect(rows[1]).To(HaveKeyWithValue("name", "1000_create_first_table.up.sql"))
+		})
+
+		It("exports an empty array before the first migration", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			exported, err := migrator.ExportVersionTable()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exported).To(MatchJSON(`[]`))
+		})
+	})
+
+	Context("IsFreshDatabase", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("reports a database that was never migrated as fresh", func() {
+			fresh, err := migrator.IsFreshDatabase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fresh).To(BeTrue())
+		})
+
+		It("does not report a database with a legacy version table as fresh", func() {
+			SetupMigrationVersionTableToExistAtVersion(db, 189)
+
+			fresh, err := migrator.IsFreshDatabase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fresh).To(BeFalse())
+		})
+
+		It("does not report a database with a schema_migrations table as fresh", func() {
+			SetupSchemaMigrationsTable(db, 8878, false)
+
+			fresh, err := migrator.IsFreshDatabase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fresh).To(BeFalse())
+		})
+
+		It("does not report a migrated database as fresh", func() {
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			fresh, err := migrator.IsFreshDatabase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fresh).To(BeFalse())
+		})
+	})
+
+	Context("Baseline", func() {
+		var assets map[string]string
+
+		BeforeEach(func() {
+			assets = map[string]string{}
+			for version := 1001; version <= 1300; version++ {
+				assets[strconv.Itoa(version)+"_create_table.up.sql"] = "CREATE TABLE table_" + strconv.Itoa(version) + " (id integer);"
+			}
+			bindata = NewMapBindata(assets)
+		})
+
+		It("records every version up to the baseline in one statement without running them", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Baseline(1250)
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1250)
+			ExpectMigrationsHistoryRowCountToEqual(db, 250)
+
+			// current_timestamp is fixed per transaction, so rows recorded by
+			// separate statements outside a transaction would not share it
+			var timestamps int
+			err = db.QueryRow("SELECT COUNT(DISTINCT tstamp) FROM migrations_history").Scan(&timestamps)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(timestamps).To(Equal(1))
+
+			var exists bool
+			err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = 'table_1001')").Scan(&exists)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			err = migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1300)
+		})
+
+		It("rejects a version without a migration", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Baseline(5000)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("UpWithProgress", func() {
+		It("reports the number of files applied after each one", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			var progress [][2]int
+			err := migrator.UpWithProgress(func(done, total int) {
+				progress = append(progress, [2]int{done, total})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(progress).To(Equal([][2]int{{1, 3}, {2, 3}, {3, 3}}))
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+	})
+
+	Context("WithMinSupportedVersion", func() {
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+		})
+
+		It("refuses to migrate a database older than the minimum", func() {
+			Expect(migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Migrate(1000)).To(Succeed())
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithMinSupportedVersion(2000))
+
+			err := migrator.Up()
+			Expect(err).To(Equal(&migration.UnsupportedVersionError{CurrentVersion: 1000, MinSupportedVersion: 2000}))
+			Expect(err.Error()).To(ContainSubstring("upgrade through an intermediate release"))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+		})
+
+		It("migrates a database at the minimum", func() {
+			Expect(migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Migrate(2000)).To(Succeed())
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithMinSupportedVersion(2000))
+
+			Expect(migrator.Up()).To(Succeed())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+
+		It("migrates an empty database", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithMinSupportedVersion(2000))
+
+			Expect(migrator.Up()).To(Succeed())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+	})
+
+	Context("when a legacy upgrade died before recording its version", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			// migrations_history was created, but the version carried over
+			// from schema_migrations was never inserted
+			_, err := db.Exec(migration.DialectForDriver("postgres").CreateVersionTable("migrations_history"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("carries over the version from schema_migrations rather than replaying the schema", func() {
+			_, err := db.Exec("CREATE TABLE first_table (id integer)")
+			Expect(err).NotTo(HaveOccurred())
+			SetupSchemaMigrationsTable(db, 1000, false)
+
+			Expect(migrator.Up()).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+			ExpectTableExistenceToEqual(db, "second_table", true)
+		})
+
+		It("fails with guidance when no version is recorded anywhere but tables exist", func() {
+			_, err := db.Exec("CREATE TABLE first_table (id integer)")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = db.Exec("CREATE TABLE schema_migrations (version bigint, dirty boolean)")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Up()
+			Expect(err).To(Equal(&migration.UnknownSchemaVersionError{Table: "first_table"}))
+			Expect(err.Error()).To(ContainSubstring("Baseline"))
+
+			ExpectTableExistenceToEqual(db, "second_table", false)
+		})
+
+		It("migrates from scratch when no version is recorded and there are no tables", func() {
+			_, err := db.Exec("CREATE TABLE schema_migrations (version bigint, dirty boolean)")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(migrator.Up()).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+		})
+	})
+
+	Context("unknown applied versions", func() {
+		It("refuses to migrate up a database with applied versions missing from the migrations", func() {
+			Expect(migration.NewMigratorForMigrations(db, lockFactory, strategy, NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+			})).Up()).To(Succeed())
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"3000_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+				"4000_create_fourth_table.up.sql": `CREATE TABLE fourth_table (id integer);`,
+			}))
+
+			err := migrator.Up()
+			Expect(err).To(Equal(&migration.UnknownAppliedVersionsError{Versions: []int{2000}}))
+			Expect(err.Error()).To(ContainSubstring("migrated by a newer release"))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+			ExpectTableExistenceToEqual(db, "fourth_table", false)
+		})
+
+		It("ignores applied versions older than every migration", func() {
+			SetupMigrationsHistoryTableToExistAtVersion(db, 500)
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql": `CREATE TABLE first_table (id integer);`,
+			}))
+
+			Expect(migrator.Up()).To(Succeed())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+		})
+	})
+
+	Context("StartAsync", func() {
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+		})
+
+		It("migrates in the background, reporting progress", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			handle, err := migrator.StartAsync(3000)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(handle.Wait()).To(Succeed())
+			Expect(handle.Err()).NotTo(HaveOccurred())
+
+			done, total := handle.Progress()
+			Expect(done).To(Equal(3))
+			Expect(total).To(Equal(3))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+
+		It("reports the error a migration failed with", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer); SELECT broken;`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			handle, err := migrator.StartAsync(1000)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(handle.Wait()).To(HaveOccurred())
+			Expect(handle.Err()).To(MatchError(ContainSubstring("broken")))
+		})
+
+		It("runs one asynchronous migration at a time", func() {
+			release := make(chan struct{})
+			logger := &hookLogger{hook: func(action string) {
+				if action == "applying-migration" {
+					<-release
+				}
+			}}
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			handle, err := migrator.StartAsync(3000)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = migrator.StartAsync(3000)
+			Expect(err).To(Equal(migration.ErrMigrationInProgress))
+
+			close(release)
+			Expect(handle.Wait()).To(Succeed())
+
+			handle, err = migrator.StartAsync(3000)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handle.Wait()).To(Succeed())
+		})
+	})
+
+	Context("WithStripComments", func() {
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_select_builds.up.sql": `SELECT /*+ IndexScan(builds) */ id /* the build */ FROM builds -- all of them
+WHERE name = '/* not a comment */';`,
+			})
+		})
+
+		It("strips normal comments but keeps optimizer hints", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithStripComments())
+
+			migrations, err := migrator.Migrations()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrations).To(HaveLen(1))
+			Expect(migrations[0].Statements).To(HaveLen(1))
+
+			sql := migrations[0].Statements[0].SQL
+			Expect(sql).To(ContainSubstring("/*+ IndexScan(builds) */"))
+			Expect(sql).NotTo(ContainSubstring("the build"))
+			Expect(sql).NotTo(ContainSubstring("all of them"))
+			Expect(sql).To(ContainSubstring("'/* not a comment */'"))
+		})
+
+		It("keeps every comment by default", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			migrations, err := migrator.Migrations()
+			Expect(err).NotTo(HaveOccurred())
+
+			sql := migrations[0].Statements[0].SQL
+			Expect(sql).To(ContainSubstring("/* the build */"))
+			Expect(sql).To(ContainSubstring("-- all of them"))
+		})
+	})
+
+	Context("empty migrations", func() {
+		It("records the version of migrations without statements without executing anything", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_describe_first_table.up.sql": `COMMENT ON TABLE first_table IS 'the first table';`,
+				"2000_describe_first_table.down.sql": `-- the comment may stay
+
+`,
+			})
+			logger := &recordingLogger{}
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migrator.Migrate(1000)).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+			Expect(logger.Logs("skipping-empty-migration")).To(Equal([]recordedLog{
+				{Action: "skipping-empty-migration", Data: migration.Data{"version": 2000, "direction": "down"}},
+			}))
+
+			Expect(migrator.Up()).To(Succeed())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+		})
+	})
+
+	Context("row count expectations", func() {
+		It("fails a statement expected to affect rows that affects none", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql": `CREATE TABLE teams (id integer, name varchar);
+INSERT INTO teams (id, name) VALUES (1, 'main');`,
+				"1000_create_teams.down.sql": `DROP TABLE teams;`,
+				"2000_rename_team.up.sql": `-- expect: rows>0
+UPDATE teams SET name = 'renamed' WHERE name = 'mian';`,
+				"2000_rename_team.down.sql": `UPDATE teams SET name = 'main' WHERE name = 'renamed';`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).To(HaveOccurred())
+
+			migrationErr, ok := err.(*migration.MigrationError)
+			Expect(ok).To(BeTrue())
+			Expect(migrationErr.Version).To(Equal(2000))
+			Expect(migrationErr.Err).To(Equal(migration.ErrNoRowsAffected))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+		})
+
+		It("passes when the statement affects rows", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql": `CREATE TABLE teams (id integer, name varchar);
+INSERT INTO teams (id, name) VALUES (1, 'main');
+-- expect: rows>0
+UPDATE teams SET name = 'renamed' WHERE name = 'main';`,
+				"1000_create_teams.down.sql": `DROP TABLE teams;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.Up()).To(Succeed())
+		})
+	})
+
+	Context("IsMigrating", func() {
+		It("is set while migrating and cleared afterwards", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+			})
+
+			var migrator migration.Migrator
+			var migratingDuringRun []bool
+			logger := &hookLogger{hook: func(action string) {
+				if action == "applying-migration" {
+					migrating, err := migrator.IsMigrating()
+					Expect(err).NotTo(HaveOccurred())
+					migratingDuringRun = append(migratingDuringRun, migrating)
+				}
+			}}
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			migrating, err := migrator.IsMigrating()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrating).To(BeFalse())
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migratingDuringRun).To(Equal([]bool{true}))
+
+			migrating, err = migrator.IsMigrating()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrating).To(BeFalse())
+		})
+
+		It("is cleared when a migration fails", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer); SELECT broken;`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.Up()).NotTo(Succeed())
+
+			migrating, err := migrator.IsMigrating()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrating).To(BeFalse())
+		})
+	})
+
+	Context("logging pending migrations", func() {
+		var (
+			logger   *recordingLogger
+			migrator migration.Migrator
+		)
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+			logger = &recordingLogger{}
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+		})
+
+		It("logs the number of pending migrations before migrating up", func() {
+			Expect(migrator.Migrate(1000)).To(Succeed())
+			Expect(migrator.Up()).To(Succeed())
+
+			logs := logger.Logs("migrating-to-supported-version")
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Data).To(Equal(migration.Data{"from": 1000, "to": 3000, "pending": 2}))
+		})
+
+		It("logs that the database is up to date", func() {
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migrator.Up()).To(Equal(migration.ErrNoChange))
+
+			logs := logger.Logs("database-up-to-date")
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Data).To(Equal(migration.Data{"version": 3000}))
+		})
+	})
+
+	Context("UpOne and DownOne", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("walks up through every version one at a time", func() {
+			for _, version := range []int{1000, 2000, 3000} {
+				Expect(migrator.UpOne()).To(Succeed())
+				ExpectDatabaseMigrationVersionToEqual(migrator, version)
+			}
+
+			Expect(migrator.UpOne()).To(Equal(migration.ErrNoMoreMigrations))
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+
+		It("walks back down through every version one at a time", func() {
+			Expect(migrator.Up()).To(Succeed())
+
+			for _, version := range []int{2000, 1000, 0} {
+				Expect(migrator.DownOne()).To(Succeed())
+				ExpectDatabaseMigrationVersionToEqual(migrator, version)
+			}
+
+			Expect(migrator.DownOne()).To(Equal(migration.ErrNoMoreMigrations))
+		})
+	})
+
+	Context("Up", func() {
+		It("reports every version it applied, including the last", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+			})
+
+			logger := &recordingLogger{}
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			Expect(migrator.Up()).To(Succeed())
+
+			migrated := logger.Logs("migrated-to-supported-version")
+			Expect(migrated).To(HaveLen(1))
+			Expect(migrated[0].Data["applied"]).To(Equal([]int{1000, 2000}))
+			Expect(migrated[0].Data["to"]).To(Equal(2000))
+		})
+	})
+
+	Context("UpToLatestMinus", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("stops the given number of versions before the latest", func() {
+			Expect(migrator.UpToLatestMinus(1)).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+			ExpectTableExistenceToEqual(db, "third_table", false)
+		})
+
+		It("migrates to the latest version for 0", func() {
+			Expect(migrator.UpToLatestMinus(0)).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+
+		It("fails for more versions than there are migrations", func() {
+			err := migrator.UpToLatestMinus(3)
+			Expect(err).To(MatchError("cannot migrate to 3 versions before the latest of 3 migrations"))
+
+			ExpectTableExistenceToEqual(db, "first_table", false)
+		})
+
+		It("refuses to migrate down", func() {
+			Expect(migrator.Up()).To(Succeed())
+
+			err := migrator.UpToLatestMinus(2)
+			Expect(err).To(MatchError("database is at version 3000, which is past version 1000; refusing to migrate down"))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		})
+	})
+
+	Context("Repair", func() {
+		It("rolls back to the known good version and reapplies under one lock", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+			})
+
+			Expect(migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata).Up()).To(Succeed())
+
+			logger := &recordingLogger{}
+			fakeLock := new(lockfakes.FakeLock)
+			fakeLockFactory := new(lockfakes.FakeLockFactory)
+			fakeLockFactory.AcquireReturns(fakeLock, true, nil)
+
+			migrator := migration.NewMigratorForMigrations(db, fakeLockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			Expect(migrator.Repair(1000)).To(Succeed())
+
+			Expect(fakeLockFactory.AcquireCallCount()).To(Equal(1))
+			Expect(fakeLock.ReleaseCallCount()).To(Equal(1))
+
+			Expect(logger.Logs("repair-rolling-back")).To(HaveLen(1))
+			Expect(logger.Logs("repair-reapplying")).To(HaveLen(1))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+			ExpectTableExistenceToEqual(db, "second_table", true)
+		})
+	})
+
+	Context("WithVerbosePlan", func() {
+		var logger *recordingLogger
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+			})
+			logger = &recordingLogger{}
+		})
+
+		It("logs every file to apply before applying the first", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLogger(logger),
+				migration.WithVerbosePlan(),
+			)
+
+			Expect(migrator.Up()).To(Succeed())
+
+			logs := logger.Logs("about-to-apply")
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Data).To(Equal(migration.Data{
+				"direction":  "up",
+				"from":       0,
+				"to":         2000,
+				"migrations": []string{"1000_create_first_table.up.sql", "2000_create_second_table.up.sql"},
+			}))
+
+			actions := logger.Actions()
+			planIndex, applyIndex := -1, -1
+			for i, action := range actions {
+				if action == "about-to-apply" && planIndex == -1 {
+					planIndex = i
+				}
+				if action == "applying-migration" && applyIndex == -1 {
+					applyIndex = i
+				}
+			}
+			Expect(planIndex).To(BeNumerically("<", applyIndex))
+		})
+
+		It("logs the plan before writing anything to the database", func() {
+			var versionTablesAtPlan int
+			hooked := &hookLogger{hook: func(action string) {
+				if action == "about-to-apply" {
+					err := db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_name IN ('migrations_history', 'migration_timings', 'migration_state', 'migration_progress')").Scan(&versionTablesAtPlan)
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}}
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLogger(hooked),
+				migration.WithVerbosePlan(),
+			)
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(hooked.Logs("about-to-apply")).To(HaveLen(1))
+			Expect(versionTablesAtPlan).To(BeZero())
+		})
+
+		It("logs the down migrations to apply, newest first", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLogger(logger),
+				migration.WithVerbosePlan(),
+			)
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migrator.Migrate(0)).To(Succeed())
+
+			logs := logger.Logs("about-to-apply")
+			Expect(logs).To(HaveLen(2))
+			Expect(logs[1].Data["migrations"]).To(Equal([]string{"2000_create_second_table.down.sql", "1000_create_first_table.down.sql"}))
+		})
+
+		It("logs no plan by default", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithLogger(logger))
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(logger.Logs("about-to-apply")).To(BeEmpty())
+		})
+	})
+
+	Context("WithTxMigration", func() {
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql": `CREATE TABLE first_table (id integer);`,
+				"2000_seed_first_table.up.sql":   `-- seeded by a Go migration`,
+			})
+		})
+
+		It("runs the Go migration in the transaction of the SQL migration", func() {
+			seed := func(ctx context.Context, tx *sql.Tx, strategy encryption.Strategy) error {
+				_, err := tx.ExecContext(ctx, "INSERT INTO first_table (id) VALUES (1)")
+				return err
+			}
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithTxMigration(2000, "up", seed),
+			)
+
+			Expect(migrator.Up()).To(Succeed())
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+
+			var count int
+			err := db.QueryRow("SELECT COUNT(*) FROM first_table").Scan(&count)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("rolls back the SQL of the version when the Go migration fails", func() {
+			disaster := errors.New("disaster")
+			fail := func(ctx context.Context, tx *sql.Tx, strategy encryption.Strategy) error {
+				return disaster
+			}
+
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithTxMigration(1000, "up", fail),
+			)
+
+			err := migrator.Up()
+			Expect(err).To(HaveOccurred())
+
+			migrationErr, ok := err.(*migration.MigrationError)
+			Expect(ok).To(BeTrue())
+			Expect(migrationErr.Version).To(Equal(1000))
+			Expect(migrationErr.RolledBack).To(BeTrue())
+			Expect(migrationErr.Err).To(Equal(disaster))
+
+			ExpectTableExistenceToEqual(db, "first_table", false)
+		})
+	})
+
+	Context("missing down migrations", func() {
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":  `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":   `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql": `DROP TABLE third_table;`,
+			})
+		})
+
+		It("refuses to migrate down past a version without a down migration, running none", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+			Expect(migrator.Up()).To(Succeed())
+
+			err := migrator.Migrate(0)
+			Expect(err).To(Equal(&migration.IrreversibleMigrationError{Versions: []int{2000}, TargetVersion: 0}))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+			ExpectTableExistenceToEqual(db, "second_table", true)
+			ExpectTableExistenceToEqual(db, "third_table", true)
+		})
+
+		It("lists every version without a down migration", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":  `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":   `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql": `DROP TABLE third_table;`,
+				"4000_create_fourth_table.up.sql":  `CREATE TABLE fourth_table (id integer);`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+			Expect(migrator.Up()).To(Succeed())
+
+			err := migrator.Migrate(0)
+			Expect(err).To(MatchError("cannot migrate down to version 0: no down migrations for versions 4000, 2000"))
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 4000)
+		})
+
+		It("migrates down to a version without a down migration", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+			Expect(migrator.Up()).To(Succeed())
+
+			Expect(migrator.Migrate(2000)).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+			ExpectTableExistenceToEqual(db, "third_table", false)
+		})
+
+		It("refuses to migrate when down migrations are required", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithRequireDownFiles())
+
+			err := migrator.Up()
+			Expect(err).To(MatchError("missing down migrations for versions: 2000"))
+
+			ExpectTableExistenceToEqual(db, "first_table", false)
+		})
+	})
+
+	Context("Plan", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer); CREATE INDEX second_table_id ON second_table (id);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("lists the up migrations in ascending order without applying them", func() {
+			plan, err := migrator.Plan(3000)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(plan).To(HaveLen(3))
+			Expect(plan[0].Filename).To(Equal("1000_create_first_table.up.sql"))
+			Expect(plan[1].Filename).To(Equal("2000_create_second_table.up.sql"))
+			Expect(plan[2].Filename).To(Equal("3000_create_third_table.up.sql"))
+
+			Expect(plan[1].Version).To(Equal(2000))
+			Expect(plan[1].Direction).To(Equal("up"))
+			Expect(plan[1].Statements).To(HaveLen(2))
+			Expect(plan[1].Statements[1].SQL).To(Equal("CREATE INDEX second_table_id ON second_table (id)"))
+
+			var exists bool
+			err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name IN ('migrations_history', 'first_table'))").Scan(&exists)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("lists the down migrations in descending order", func() {
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			plan, err := migrator.Plan(0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(plan).To(HaveLen(3))
+			Expect(plan[0].Filename).To(Equal("3000_create_third_table.down.sql"))
+			Expect(plan[1].Filename).To(Equal("2000_create_second_table.down.sql"))
+			Expect(plan[2].Filename).To(Equal("1000_create_first_table.down.sql"))
+		})
+
+		Context("DownPlan", func() {
+			BeforeEach(func() {
+				Expect(migrator.Up()).To(Succeed())
+			})
+
+			It("lists the down migrations past the target, newest first, without running them", func() {
+				plan, err := migrator.DownPlan(1000)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(plan).To(HaveLen(2))
+				Expect(plan[0].Filename).To(Equal("3000_create_third_table.down.sql"))
+				Expect(plan[0].Version).To(Equal(3000))
+				Expect(plan[0].Direction).To(Equal("down"))
+				Expect(plan[1].Filename).To(Equal("2000_create_second_table.down.sql"))
+				Expect(plan[1].Statements).To(HaveLen(1))
+				Expect(plan[1].Statements[0].SQL).To(Equal("DROP TABLE second_table"))
+
+				ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+				ExpectTableExistenceToEqual(db, "third_table", true)
+			})
+
+			It("is empty when the database is not past the target", func() {
+				plan, err := migrator.DownPlan(3000)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("asset lookup", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_seed_first_table.up.sql":     `INSERT INTO first_table (id) VALUES (1);`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		It("finds the up and down files of a reversible version", func() {
+			filename, found := migration.UpAsset(migrator, 1000)
+			Expect(found).To(BeTrue())
+			Expect(filename).To(Equal("1000_create_first_table.up.sql"))
+
+			filename, found = migration.DownAsset(migrator, 1000)
+			Expect(found).To(BeTrue())
+			Expect(filename).To(Equal("1000_create_first_table.down.sql"))
+		})
+
+		It("finds no down file for a version without one", func() {
+			filename, found := migration.UpAsset(migrator, 2000)
+			Expect(found).To(BeTrue())
+			Expect(filename).To(Equal("2000_seed_first_table.up.sql"))
+
+			_, found = migration.DownAsset(migrator, 2000)
+			Expect(found).To(BeFalse())
+		})
+
+		It("finds nothing for an unknown version", func() {
+			_, found := migration.UpAsset(migrator, 3000)
+			Expect(found).To(BeFalse())
+
+			_, found = migration.DownAsset(migrator, 3000)
+			Expect(found).To(BeFalse())
+		})
+
+		It("lists the files of each direction in order of version", func() {
+			bindata = NewMapBindata(map[string]string{
+				"3000_create_third_table.up.sql":   `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql": `DROP TABLE third_table;`,
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_seed_first_table.up.sql":     `INSERT INTO first_table (id) VALUES (1);`,
+				"README.md":                        `not a migration`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.MigrationFilesFor("up")).To(Equal([]string{
+				"1000_create_first_table.up.sql",
+				"2000_seed_first_table.up.sql",
+				"3000_create_third_table.up.sql",
+			}))
+			Expect(migrator.MigrationFilesFor("down")).To(Equal([]string{
+				"1000_create_first_table.down.sql",
+				"3000_create_third_table.down.sql",
+			}))
+			Expect(migrator.MigrationFilesFor("sideways")).To(BeEmpty())
+		})
+	})
+
+	Context("migrationsBetween", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+				"3000_create_third_table.up.sql":    `CREATE TABLE third_table (id integer);`,
+				"3000_create_third_table.down.sql":  `DROP TABLE third_table;`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+		})
+
+		for _, c := range []struct {
+			description string
+			current     int
+			target      int
+			versions    []int
+			direction   string
+		}{
+			{"runs every version up from an empty database", 0, 3000, []int{1000, 2000, 3000}, "up"},
+			{"runs the versions after current up to the target", 1000, 2000, []int{2000}, "up"},
+			{"includes a target between versions up to the last one before it", 0, 2500, []int{1000, 2000}, "up"},
+			{"runs nothing when current is the target", 2000, 2000, []int{}, "up"},
+			{"runs nothing past the last version", 3000, 4000, []int{}, "up"},
+			{"reverts the versions after the target, newest first", 3000, 1000, []int{3000, 2000}, "down"},
+			{"reverts every version down to 0", 3000, 0, []int{3000, 2000, 1000}, "down"},
+			{"reverts only the versions up to current", 2000, 0, []int{2000, 1000}, "down"},
+			{"keeps a target between versions when going down", 3000, 1500, []int{3000, 2000}, "down"},
+		} {
+			c := c
+			It(c.description, func() {
+				versions, direction, err := migration.MigrationsBetween(migrator, c.current, c.target)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(versions).To(Equal(c.versions))
+				Expect(direction).To(Equal(c.direction))
+			})
+		}
+
+		It("returns an error listing the irreversible versions going down", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+				"2000_seed_first_table.up.sql":     `INSERT INTO first_table (id) VALUES (1);`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			_, direction, err := migration.MigrationsBetween(migrator, 2000, 0)
+			Expect(direction).To(Equal("down"))
+			Expect(err).To(Equal(&migration.IrreversibleMigrationError{Versions: []int{2000}, TargetVersion: 0}))
+		})
+	})
+
+	Context("Reconcile", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":  `CREATE TABLE first_table (id integer);`,
+				"2000_create_second_table.up.sql": `CREATE TABLE second_table (id integer);`,
+				"3000_create_third_table.up.sql":  `CREATE TABLE third_table (id integer);`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports no drift for a database migrated by the migrator", func() {
+			report, err := migrator.Reconcile()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.CurrentVersion).To(Equal(3000))
+			Expect(report.Missing).To(BeEmpty())
+			Expect(report.Extra).To(BeEmpty())
+		})
+
+		It("reports known versions that are not recorded as applied", func() {
+			_, err := db.Exec("DELETE FROM migrations_history WHERE version = 2000")
+			Expect(err).NotTo(HaveOccurred())
+
+			report, err := migrator.Reconcile()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Missing).To(Equal([]int{2000}))
+			Expect(report.Extra).To(BeEmpty())
+		})
+
+		It("reports applied versions without a migration without changing anything", func() {
+			_, err := db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES (2500, current_timestamp - interval '1 day', 'up', 'passed', false)")
+			Expect(err).NotTo(HaveOccurred())
+
+			report, err := migrator.Reconcile()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Missing).To(BeEmpty())
+			Expect(report.Extra).To(Equal([]int{2500}))
+
+			ExpectMigrationsHistoryRowCountToEqual(db, 4)
+		})
+	})
+
+	Context("Verify", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("passes when every applied version has a migration", func() {
+			Expect(migrator.Verify()).To(Succeed())
+		})
+
+		It("reports every applied version without a migration", func() {
+			_, err := db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES (1000, current_timestamp - interval '1 day', 'up', 'passed', false), (2000, current_timestamp - interval '1 day', 'up', 'passed', false)")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Verify()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("applied version 1000 has no matching migration"))
+			Expect(err.Error()).To(ContainSubstring("applied version 2000 has no matching migration"))
+		})
+	})
+
+	Context("CheckInvariants", func() {
+		var migrator migration.Migrator
+
+		BeforeEach(func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("passes after migrating up, down and up again", func() {
+			Expect(migrator.CheckInvariants()).To(Succeed())
+
+			err := migrator.Migrate(0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrator.CheckInvariants()).To(Succeed())
+
+			err = migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrator.CheckInvariants()).To(Succeed())
+		})
+
+		It("passes after the history is compacted", func() {
+			err := migrator.Migrate(0)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.CompactHistory(1)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(migrator.CheckInvariants()).To(Succeed())
+		})
+
+		It("fails when a version is recorded as applied twice", func() {
+			_, err := db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES (2000, current_timestamp + interval '1 minute', 'up', 'passed', false)")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.CheckInvariants()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("version 2000 recorded as applied again without being reverted"))
+		})
+
+		It("fails when a version is recorded as applied after a newer one", func() {
+			_, err := db.Exec("INSERT INTO migrations_history (version, tstamp, direction, status, dirty) VALUES (1500, current_timestamp + interval '1 minute', 'up', 'passed', false)")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.CheckInvariants()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("version 1500 recorded as applied after newer version 2000"))
+		})
+	})
+
+	Context("RoundTripCheck", func() {
+		It("passes when every down migration undoes its up migration", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `DROP TABLE second_table;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			Expect(migrator.RoundTripCheck()).To(Succeed())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+			ExpectTableExistenceToEqual(db, "first_table", true)
+			ExpectTableExistenceToEqual(db, "second_table", true)
+		})
+
+		It("fails when a down migration does not undo its up migration", func() {
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":    `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql":  `DROP TABLE first_table;`,
+				"2000_create_second_table.up.sql":   `CREATE TABLE second_table (id integer);`,
+				"2000_create_second_table.down.sql": `SELECT 1;`,
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err := migrator.RoundTripCheck()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("second up"))
+			Expect(err.Error()).To(ContainSubstring("second_table"))
+		})
+	})
+
+	Context("ForceUnlock", func() {
+		var stuckLockDB *sql.DB
+
+		BeforeEach(func() {
+			stuckLockDB, err = sql.Open("postgres", postgresRunner.DataSourceName())
+			Expect(err).NotTo(HaveOccurred())
+
+			_, acquired, err := lock.NewLockFactory(stuckLockDB).Acquire(lagertest.NewTestLogger("stuck"), lock.NewDatabaseMigrationLockID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquired).To(BeTrue())
+		})
+
+		AfterEach(func() {
+			_ = stuckLockDB.Close()
+		})
+
+		It("releases a migration lock held by another session", func() {
+			_, acquired, err := lockFactory.Acquire(lagertest.NewTestLogger("test"), lock.NewDatabaseMigrationLockID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquired).To(BeFalse())
+
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			err = migrator.ForceUnlock()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
+		})
+	})
+
+	Context("advisoryLockHoldersQuery", func() {
+		It("only terminates sessions outside of the filter selecting the holders", func() {
+			for _, id := range []lock.LockID{lock.NewDatabaseMigrationLockID(), {1, 2}} {
+				query, _, err := migration.AdvisoryLockHoldersQuery(id)
+				Expect(err).NotTo(HaveOccurred())
+
+				outer := strings.SplitN(query, " FROM (", 2)
+				Expect(outer).To(HaveLen(2))
+				Expect(outer[0]).To(ContainSubstring("pg_terminate_backend(pid)"))
+				Expect(outer[1]).NotTo(ContainSubstring("pg_terminate_backend"))
+				Expect(outer[1]).To(ContainSubstring("pid != pg_backend_pid()"))
+				Expect(outer[1]).To(MatchRegexp(`OFFSET 0\) AS holders$`))
+			}
+		})
+	})
+
+	Context("without tracking", func() {
+		It("runs every migration without ever creating a version table", func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+				"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithoutTracking())
+
+			err := migrator.Up()
+			Expect(err).NotTo(HaveOccurred())
+
+			ExpectToBeAbleToInsertData(db)
+
+			for _, table := range []string{"migrations_history", "schema_migrations", "migration_version"} {
+				var exists bool
+				err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = $1)", table).Scan(&exists)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse(), table)
+			}
+		})
+	})
+
+	Context("AcquireLock", func() {
+		It("makes migrations wait until the lock is released", func() {
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			heldLock, err := migrator.AcquireLock(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			done := make(chan error, 1)
+			go func() {
+				done <- migrator.Up()
+			}()
+
+			Consistently(done, 2*time.Second).ShouldNot(Receive())
+
+			Expect(heldLock.Release()).To(Succeed())
+
+			Eventually(done, 10*time.Second).Should(Receive(BeNil()))
+			ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
+		})
+
+		It("gives up waiting when the context is cancelled", func() {
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+			heldLock, err := migrator.AcquireLock(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			defer heldLock.Release()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err = migrator.AcquireLock(ctx)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+		})
+
+		It("logs heartbeats while waiting for the lock", func() {
+			logger := &recordingLogger{}
+			fakeLockFactory := new(lockfakes.FakeLockFactory)
+			for i := 0; i < 5; i++ {
+				fakeLockFactory.AcquireReturnsOnCall(i, nil, false, nil)
+			}
+			fakeLockFactory.AcquireReturnsOnCall(5, new(lockfakes.FakeLock), true, nil)
+
+			migrator := migration.NewMigratorForMigrations(db, fakeLockFactory, strategy, bindata, migration.WithLogger(logger))
+			migration.SetLockIntervals(migrator, 10*time.Millisecond, 20*time.Millisecond)
+
+			_, err := migrator.AcquireLock(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeLockFactory.AcquireCallCount()).To(Equal(6))
+			Expect(len(logger.Logs("still-waiting-for-migration-lock"))).To(BeNumerically(">=", 1))
+			Expect(logger.Logs("acquired-migration-lock")).To(HaveLen(1))
+			Expect(logger.Logs("acquired-migration-lock")[0].Data).To(HaveKey("waited"))
+		})
+
+		It("retries connection errors while acquiring the lock", func() {
+			logger := &recordingLogger{}
+			fakeLockFactory := new(lockfakes.FakeLockFactory)
+			fakeLockFactory.AcquireReturnsOnCall(0, nil, false, driver.ErrBadConn)
+			fakeLockFactory.AcquireReturnsOnCall(1, new(lockfakes.FakeLock), true, nil)
+
+			migrator := migration.NewMigratorForMigrations(db, fakeLockFactory, strategy, bindata, migration.WithLogger(logger))
+			migration.SetLockIntervals(migrator, 10*time.Millisecond, time.Minute)
+
+			acquiredLock, err := migrator.AcquireLock(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquiredLock).NotTo(BeNil())
+
+			Expect(fakeLockFactory.AcquireCallCount()).To(Equal(2))
+			Expect(logger.Logs("retrying-lock-acquisition")).To(HaveLen(1))
+		})
+
+		It("gives up once connection errors outlast the lock error timeout", func() {
+			fakeLockFactory := new(lockfakes.FakeLockFactory)
+			fakeLockFactory.AcquireReturns(nil, false, driver.ErrBadConn)
+
+			migrator := migration.NewMigratorForMigrations(db, fakeLockFactory, strategy, bindata,
+				migration.WithLockErrorTimeout(50*time.Millisecond),
+			)
+			migration.SetLockIntervals(migrator, 10*time.Millisecond, time.Minute)
+
+			_, err := migrator.AcquireLock(context.Background())
+			Expect(err).To(Equal(driver.ErrBadConn))
+		})
+
+		It("does not retry other errors", func() {
+			disaster := errors.New("permission denied for function pg_try_advisory_lock")
+			fakeLockFactory := new(lockfakes.FakeLockFactory)
+			fakeLockFactory.AcquireReturns(nil, false, disaster)
+
+			migrator := migration.NewMigratorForMigrations(db, fakeLockFactory, strategy, bindata)
+
+			_, err := migrator.AcquireLock(context.Background())
+			Expect(err).To(Equal(disaster))
+			Expect(fakeLockFactory.AcquireCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("with a custom lock ID", func() {
+		It("does not wait for migrations holding a different lock", func() {
+			otherLockDB, err := sql.Open("postgres", postgresRunner.DataSourceName())
+			Expect(err).NotTo(HaveOccurred())
+			defer otherLockDB.Close()
+
+			otherLock, acquired, err := lock.NewLockFactory(otherLockDB).Acquire(lagertest.NewTestLogger("other"), lock.NewNamedDatabaseMigrationLockID("other-schema"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquired).To(BeTrue())
+			defer otherLock.Release()
+
+			bindata.AssetNamesReturns([]string{
+				"1510262030_initial_schema.up.sql",
+			})
+			migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata,
+				migration.WithLockID(lock.NewNamedDatabaseMigrationLockID("this-schema")),
+			)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- migrator.Up()
+			}()
+
+			Eventually(done, 10*time.Second).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("WithSchema", func() {
+		var migrator migration.Migrator
+
+		tableSchemas := func(table string) []string {
+			rows, err := db.Query("SELECT table_schema FROM information_schema.tables WHERE table_name = $1 ORDER BY table_schema", table)
+			Expect(err).NotTo(HaveOccurred())
+			defer rows.Close()
+
+			schemas := []string{}
+			for rows.Next() {
+				var schema string
+				Expect(rows.Scan(&schema)).To(Succeed())
+				schemas = append(schemas, schema)
+			}
+			return schemas
+		}
+
+		BeforeEach(func() {
+			_, err := db.Exec("CREATE SCHEMA tenant")
+			Expect(err).NotTo(HaveOccurred())
+
+			bindata = NewMapBindata(map[string]string{
+				"1000_create_first_table.up.sql":   `CREATE TABLE first_table (id integer);`,
+				"1000_create_first_table.down.sql": `DROP TABLE first_table;`,
+			})
+			migrator = migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata, migration.WithSchema("tenant"))
+		})
+
+		It("migrates in parallel with other schemas but not with the same one", func() {
+			_, err := db.Exec("CREATE SCHEMA other_tenant")
+			Expect(err).NotTo(HaveOccurred())
+
+			tenantLockDB, err := sql.Open("postgres", postgresRunner.DataSourceName())
+			Expect(err).NotTo(HaveOccurred())
+			defer tenantLockDB.Close()
+
+			// a migration of the tenant schema is in progress elsewhere
+			tenantLock, acquired, err := lock.NewLockFactory(tenantLockDB).Acquire(lagertest.NewTestLogger("tenant"), lock.NewNamedDatabaseMigrationLockID("tenant"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acquired).To(BeTrue())
+
+			otherBindata := NewMapBindata(map[string]string{
+				"1000_create_other_table.up.sql": `CREATE TABLE other_table (id integer);`,
+			})
+			otherMigrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, otherBindata, migration.WithSchema("other_tenant"))
+
+			otherDone := make(chan error, 1)
+			go func() {
+				otherDone <- otherMigrator.Up()
+			}()
+
+			tenantDone := make(chan error, 1)
+			go func() {
+				tenantDone <- migrator.Up()
+			}()
+
+			Eventually(otherDone, 10*time.Second).Should(Receive(BeNil()))
+			Consistently(tenantDone, time.Second).ShouldNot(Receive())
+
+			tenantLock.Release()
+
+			Eventually(tenantDone, 10*time.Second).Should(Receive(BeNil()))
+
+			Expect(tableSchemas("migrations_history")).To(Equal([]string{"other_tenant", "tenant"}))
+		})
+
+		It("keeps the version table in the schema", func() {
+			Expect(migrator.Up()).To(Succeed())
+
+			Expect(tableSchemas("migrations_history")).To(Equal([]string{"tenant"}))
+			ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+			Expect(tableSchemas("migration_timings")).To(Equal([]string{"tenant"}))
+			Expect(tableSchemas("migration_progress")).To(Equal([]string{"tenant"}))
+			timings, err := migrator.Timings(1000)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(timings).To(HaveLen(1))
+
+			Expect(migrator.Up()).To(Equal(migration.ErrNoChange))
+		})
+
+		It("keeps the legacy version table in the schema when migrating down", func() {
+			Expect(migrator.Up()).To(Succeed())
+			Expect(migrator.Migrate(0)).To(Succeed())
+
+			Expect(tableSchemas("schema_migrations")).To(Equal([]string{"tenant"}))
+		})
+
+		It("ignores version tables in other schemas", func() {
+			SetupMigrationsHistoryTableToExistAtVersion(db, 1000)
+
+			fresh, err := migrator.IsFreshDatabase()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fresh).To(BeTrue())
+		})
+	})
+
+	Context("WithPostMigrateAnalyze", func() {
+		var fakeConn *sql.DB
+
+		BeforeEach(func() {
+			fakeDB.Reset()
+
+			var err error
+			fakeConn, err = sql.Open(fakeDriverName, "some-dsn")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			_ = fakeConn.Close()
+		})
+
+		analyzes := func() int {
+			count := 0
+			for _, statement := range fakeDB.Execs() {
+				if statement == "ANALYZE" {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("analyzes the database after applying migrations", func() {
+			migrator := migration.NewMigratorForMigrations(fakeConn, nil, strategy, NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql": `CREATE TABLE teams (id integer);`,
+			}), migration.WithDialect(migration.NewCockroachDialect()), migration.WithPostMigrateAnalyze())
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(analyzes()).To(Equal(1))
+		})
+
+		It("does not analyze the database by default", func() {
+			migrator := migration.NewMigratorForMigrations(fakeConn, nil, strategy, NewMapBindata(map[string]string{
+				"1000_create_teams.up.sql": `CREATE TABLE teams (id integer);`,
+			}), migration.WithDialect(migration.NewCockroachDialect()))
+
+			Expect(migrator.Up()).To(Succeed())
+			Expect(analyzes()).To(BeZero())
+		})
+	})
+
+	Context("WithNoticeLogging", func() {
+		var (
+			fakeConn *sql.DB
+			logger   *recordingLogger
+		)
+
+		BeforeEach(func() {
+			fakeDB.Reset()
+
+			var err error
+			fakeConn, err = sql.Open(fakeDriverName, "some-dsn")
+			Expect(err).NotTo(HaveOccurred())
+
+			logger = &recordingLogger{}
+
+			fakeDB.RaiseNotice("ALTER TABLE teams ALTER COLUMN id TYPE bigint", &pq.Error{
+				Severity: "WARNING",
+				Message:  "rewriting table \"teams\"",
+			})
+		})
+
+		AfterEach(func() {
+			_ = fakeConn.Close()
+		})
+
+		newMigrator := func(opts ...migration.MigratorOption) migration.Migrator {
+			migrator := migration.NewMigratorForMigrations(fakeConn, nil, strategy, NewMapBindata(map[string]string{
+				"1000_alter_teams.up.sql": `ALTER TABLE teams ALTER COLUMN id TYPE bigint;`,
+			}), append(opts, migration.WithDialect(migration.NewCockroachDialect()), migration.WithLogger(logger))...)
+			migration.SetNoticeHandlerFunc(migrator, SetNoticeHandler)
+			return migrator
+		}
+
+		It("logs the warnings raised by a migration with its version", func() {
+			Expect(newMigrator(migration.WithNoticeLogging()).Up()).To(Succeed())
+
+			warnings := logger.Logs("database-warning")
+			Expect(warnings).To(HaveLen(1))
+			Expect(warnings[0].Data["version"]).To(Equal(1000))
+			Expect(warnings[0].Data["message"]).To(Equal("rewriting table \"teams\""))
+		})
+
+		It("does not log notices by default", func() {
+			Expect(newMigrator().Up()).To(Succeed())
+
+			Expect(logger.Logs("database-warning")).To(BeEmpty())
+		})
+	})
+
+	Context("Downgrade", func() {
+		Context("Downgrades to a version that uses the old mattes/migrate schema_migrations table", func() {
+			It("Downgrades to a given version and write it to a new created schema_migrations table", func() {
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+					"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				err := migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+
+				currentVersion, err := migrator.CurrentVersion()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentVersion).To(Equal(upgradedSchemaVersion))
+
+				err = migrator.Migrate(initialSchemaVersion)
+				Expect(err).NotTo(HaveOccurred())
+
+				currentVersion, err = migrator.CurrentVersion()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentVersion).To(Equal(initialSchemaVersion))
+
+				ExpectDatabaseVersionToEqual(db, initialSchemaVersion, "schema_migrations")
+
+				ExpectToBeAbleToInsertData(db)
+			})
+
+			It("Downgrades to a given version and write it to the existing schema_migrations table with dirty true", func() {
+
+				bindata.AssetNamesReturns([]string{
+					"1510262030_initial_schema.up.sql",
+					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
+					"1510670987_update_unique_constraint_for_resource_caches.down.sql",
+				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
+
+				err := migrator.Up()
+				Expect(err).NotTo(HaveOccurred())
+
+				currentVersion, err := migrator.CurrentVersion()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentVersion).To(Equal(upgradedSchemaVersion))
+
+				SetupSchemaMigrationsTable(db, 8878, true)
+
+				err = migrator.Migrate(initialSchemaVersion)
+				Expect(err).NotTo(HaveOccurred())
+
+				currentVersion, err = migrator.CurrentVersion()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(currentVersion).To(Equal(initialSchemaVersion))
+
+				ExpectDatabaseVersionToEqual(db, initialSchemaVersion, "schema_migrations")
 
 				ExpectToBeAbleToInsertData(db)
 			})
@@ -518,7 +3286,7 @@ var _ = Describe("Migration", func() {
 				ExpectToBeAbleToInsertData(db)
 			})
 
-			It("Doesn't fail if already at the requested version", func() {
+			It("returns ErrNoChange if already at the requested version", func() {
 				bindata.AssetNamesReturns([]string{
 					"1510262030_initial_schema.up.sql",
 					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
@@ -533,7 +3301,7 @@ var _ = Describe("Migration", func() {
 				Expect(currentVersion).To(Equal(upgradedSchemaVersion))
 
 				err = migrator.Migrate(upgradedSchemaVersion)
-				Expect(err).NotTo(HaveOccurred())
+				Expect(err).To(Equal(migration.ErrNoChange))
 
 				currentVersion, err = migrator.CurrentVersion()
 				Expect(err).NotTo(HaveOccurred())
@@ -543,12 +3311,12 @@ var _ = Describe("Migration", func() {
 			})
 
 			It("Locks the database so multiple consumers don't run downgrade at the same time", func() {
-				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 				bindata.AssetNamesReturns([]string{
 					"1510262030_initial_schema.up.sql",
 					"1510670987_update_unique_constraint_for_resource_caches.up.sql",
 					"1510670987_update_unique_constraint_for_resource_caches.down.sql",
 				})
+				migrator := migration.NewMigratorForMigrations(db, lockFactory, strategy, bindata)
 
 				err := migrator.Up()
 				Expect(err).NotTo(HaveOccurred())
@@ -571,8 +3339,11 @@ func TryRunUpAndVerifyResult(db *sql.DB, migrator migration.Migrator, wg *sync.W
 	defer GinkgoRecover()
 	defer wg.Done()
 
+	// only one of the concurrent runs finds anything to migrate
 	err := migrator.Up()
-	Expect(err).NotTo(HaveOccurred())
+	if err != migration.ErrNoChange {
+		Expect(err).NotTo(HaveOccurred())
+	}
 
 	ExpectDatabaseMigrationVersionToEqual(migrator, initialSchemaVersion)
 
@@ -584,7 +3355,9 @@ func TryRunMigrateAndVerifyResult(db *sql.DB, migrator migration.Migrator, versi
 	defer wg.Done()
 
 	err := migrator.Migrate(version)
-	Expect(err).NotTo(HaveOccurred())
+	if err != migration.ErrNoChange {
+		Expect(err).NotTo(HaveOccurred())
+	}
 
 	ExpectDatabaseMigrationVersionToEqual(migrator, version)
 
@@ -647,3 +3420,17 @@ func ExpectMigrationToHaveFailed(dbConn *sql.DB, failedVersion int, expectDirty
 	Expect(status).To(Equal("failed"))
 	Expect(dirty).To(Equal(expectDirty))
 }
+
+func ExpectMigrationsHistoryRowCountToEqual(dbConn *sql.DB, expected int) {
+	var count int
+	err := dbConn.QueryRow("SELECT COUNT(*) FROM migrations_history").Scan(&count)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(count).To(Equal(expected))
+}
+
+func ExpectTableExistenceToEqual(dbConn *sql.DB, table string, expected bool) {
+	var exists bool
+	err := dbConn.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = $1)", table).Scan(&exists)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(exists).To(Equal(expected))
+}
@@ -0,0 +1,67 @@
+// Package migrationtest provides a database migrated to the supported
+// version for the tests of packages that depend on the schema.
+package migrationtest
+
+import (
+	"database/sql"
+
+	"github.com/concourse/atc/db/encryption"
+	"github.com/concourse/atc/db/lock"
+	"github.com/concourse/atc/db/migration"
+	_ "github.com/lib/pq"
+)
+
+// TestingT is the subset of *testing.T used by NewMigratedDB.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// NewMigratedDB opens the Postgres database at dsn and migrates it up to the
+// supported version. Once the test finishes, every migration is reverted, the
+// migrator's own tables are dropped and the connections are closed.
+func NewMigratedDB(t TestingT, dsn string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	lockConn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		db.Close()
+		t.Fatalf("failed to open lock connection: %s", err)
+	}
+
+	lockConn.SetMaxOpenConns(1)
+	lockConn.SetMaxIdleConns(1)
+	lockConn.SetConnMaxLifetime(0)
+
+	migrator := migration.NewMigrator(db, lock.NewLockFactory(lockConn), encryption.NewNoEncryption())
+
+	t.Cleanup(func() {
+		defer db.Close()
+		defer lockConn.Close()
+
+		err := migrator.Migrate(0)
+		if err != nil && err != migration.ErrNoChange {
+			t.Errorf("failed to migrate database down: %s", err)
+			return
+		}
+
+		_, err = db.Exec("DROP TABLE IF EXISTS migrations_history, migration_timings, migration_state, migration_progress, schema_migrations")
+		if err != nil {
+			t.Errorf("failed to drop migration tables: %s", err)
+		}
+	})
+
+	err = migrator.Up()
+	if err != nil && err != migration.ErrNoChange {
+		t.Fatalf("failed to migrate database: %s", err)
+	}
+
+	return db
+}
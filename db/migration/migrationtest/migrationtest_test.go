@@ -0,0 +1,85 @@
+package migrationtest_test
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/concourse/atc/db/migration/migrationtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeT struct {
+	errors   []string
+	cleanups []func()
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	panic("fatal: " + t.errors[len(t.errors)-1])
+}
+
+func (t *fakeT) Cleanup(cleanup func()) {
+	t.cleanups = append(t.cleanups, cleanup)
+}
+
+func (t *fakeT) runCleanups() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+var _ = Describe("NewMigratedDB", func() {
+	var (
+		t      *fakeT
+		verify *sql.DB
+	)
+
+	BeforeEach(func() {
+		t = &fakeT{}
+
+		var err error
+		verify, err = sql.Open("postgres", postgresRunner.DataSourceName())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		_ = verify.Close()
+	})
+
+	tableCount := func() int {
+		var count int
+		err := verify.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public'").Scan(&count)
+		Expect(err).NotTo(HaveOccurred())
+		return count
+	}
+
+	It("migrates the database and drops everything on cleanup", func() {
+		db := migrationtest.NewMigratedDB(t, postgresRunner.DataSourceName())
+		Expect(t.errors).To(BeEmpty())
+
+		_, err := db.Exec("SELECT 1 FROM teams")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tableCount()).NotTo(BeZero())
+
+		t.runCleanups()
+		Expect(t.errors).To(BeEmpty())
+
+		Expect(tableCount()).To(BeZero())
+		Expect(db.Ping()).To(HaveOccurred())
+	})
+
+	It("fails the test when the database cannot be migrated", func() {
+		Expect(func() {
+			migrationtest.NewMigratedDB(t, "host=/nonexistent dbname=nowhere")
+		}).To(Panic())
+
+		Expect(t.errors).To(ConsistOf(ContainSubstring("failed to migrate database")))
+	})
+})
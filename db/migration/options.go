@@ -0,0 +1,315 @@
+package migration
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/concourse/atc/db/lock"
+)
+
+type MigratorOption func(*migrator)
+
+// WithLogger sets the Logger the migrator logs to. Use NewLagerLogger to log
+// to a lager.Logger.
+func WithLogger(logger Logger) MigratorOption {
+	return func(m *migrator) {
+		m.logger = logger
+	}
+}
+
+// WithTemplateData provides the values used to render `.tmpl` migrations
+// (e.g. `1234_seed_teams.up.sql.tmpl`) with text/template before they are
+// parsed.
+func WithTemplateData(data map[string]string) MigratorOption {
+	return func(m *migrator) {
+		m.templateData = data
+	}
+}
+
+// WithStripComments removes the comments from the statements of
+// transactional SQL migrations before they are logged and executed, except
+// for optimizer hints written as /*+ ... */, which the database needs.
+func WithStripComments() MigratorOption {
+	return func(m *migrator) {
+		m.stripComments = true
+	}
+}
+
+// WithAtomicRun makes a failed upgrade run the down migrations back to the
+// version the database was at before the run started, so that either every
+// migration is applied or none are.
+func WithAtomicRun() MigratorOption {
+	return func(m *migrator) {
+		m.atomicRun = true
+	}
+}
+
+// WithStatementTransform rewrites each parsed SQL statement before it is
+// executed, e.g. to qualify table names with a tenant's schema.
+func WithStatementTransform(transform func(statement string) (string, error)) MigratorOption {
+	return func(m *migrator) {
+		m.statementTransform = transform
+	}
+}
+
+// WithIsolationLevel sets the isolation level of the transaction that
+// transactional SQL migrations run in. The driver's default is used otherwise.
+func WithIsolationLevel(level sql.IsolationLevel) MigratorOption {
+	return func(m *migrator) {
+		m.isolationLevel = level
+	}
+}
+
+// WithConnectionPerMigration runs each SQL migration file on a connection of
+// its own, which is closed afterwards rather than returned to the pool, so
+// that session settings changed by one file without LOCAL, such as
+// search_path or statement_timeout, do not apply to the next. Go migrations
+// still use the pool.
+func WithConnectionPerMigration() MigratorOption {
+	return func(m *migrator) {
+		m.connPerMigration = true
+	}
+}
+
+// WithAutoResumeDirty makes Up attempt a migration that left the database
+// dirty again rather than failing. A NO_TRANSACTION migration resumes after
+// the last statement migration_progress records as done, skipping the
+// indexes that already exist and the statements failing with errors the
+// ErrorClassifier deems ignorable from there on, as with
+// WithSkipExistingIndexes. A legacy schema_migrations table left dirty at a
+// version resumes from the version before it.
+func WithAutoResumeDirty() MigratorOption {
+	return func(m *migrator) {
+		m.autoResumeDirty = true
+	}
+}
+
+// WithNoticeLogging logs the NOTICE and WARNING messages Postgres raises
+// while running SQL migrations, such as for an ALTER TABLE that rewrites the
+// table, tagged with the version of the migration. Warnings are logged as
+// errors. Each migration file then runs on a connection of its own, which
+// must be a lib/pq connection; migrating fails before running anything
+// otherwise.
+func WithNoticeLogging() MigratorOption {
+	return func(m *migrator) {
+		m.logNotices = true
+	}
+}
+
+// WithTxMigration runs migration within the transaction of the SQL migration
+// of the given version and direction, after its statements, so that Go code
+// that must be atomic with the SQL commits or rolls back along with it. The
+// version needs a transactional SQL migration file, which may consist only of
+// comments if there is no SQL to run.
+func WithTxMigration(version int, direction string, migration TxMigration) MigratorOption {
+	return func(m *migrator) {
+		if m.txMigrations == nil {
+			m.txMigrations = map[txMigrationKey]TxMigration{}
+		}
+
+		m.txMigrations[txMigrationKey{version, direction}] = migration
+	}
+}
+
+// WithOwnershipCheck logs a warning before migrating if the connected role
+// does not own the tables it may need to alter.
+func WithOwnershipCheck() MigratorOption {
+	return func(m *migrator) {
+		m.checkOwnership = true
+	}
+}
+
+// WithStopAfterCurrent stops an upgrade once stop is closed, letting the
+// migration file in progress finish rather than interrupting it mid-statement.
+// Migrate then returns a *StoppedEarlyError, which errors.Is matches to
+// ErrStoppedEarly.
+func WithStopAfterCurrent(stop <-chan struct{}) MigratorOption {
+	return func(m *migrator) {
+		m.stopAfterCurrent = stop
+	}
+}
+
+// WithDriverName selects the SQL dialect registered for the named
+// database/sql driver. Postgres is assumed for drivers without one.
+func WithDriverName(driver string) MigratorOption {
+	return func(m *migrator) {
+		m.dialect = DialectForDriver(driver)
+	}
+}
+
+// WithDialect sets the SQL dialect directly, without registering it.
+func WithDialect(dialect Dialect) MigratorOption {
+	return func(m *migrator) {
+		m.dialect = dialect
+	}
+}
+
+// WithEnvironment sets the environment the migrator runs in, e.g. "dev" or
+// "prod". Migrations with an "-- atc:env" header that does not list it are
+// recorded as applied without being run. Without an environment, migrating
+// fails at the first migration with an "-- atc:env" header.
+func WithEnvironment(environment string) MigratorOption {
+	return func(m *migrator) {
+		m.environment = environment
+	}
+}
+
+// WithLockID sets the advisory lock taken while migrating, so that migrations
+// of independent schemas in one cluster do not wait on each other. See
+// lock.NewNamedDatabaseMigrationLockID.
+func WithLockID(id lock.LockID) MigratorOption {
+	return func(m *migrator) {
+		m.lockID = id
+	}
+}
+
+// WithSkipExistingIndexes skips any CREATE INDEX CONCURRENTLY of a
+// NO_TRANSACTION migration whose index already exists and is valid, as well
+// as any of its statements failing with an error the ErrorClassifier deems
+// ignorable. This lets a migration be retried after failing part way
+// through on Postgres versions without CREATE INDEX IF NOT EXISTS.
+func WithSkipExistingIndexes() MigratorOption {
+	return func(m *migrator) {
+		m.skipExistingIndexes = true
+	}
+}
+
+// WithoutTracking runs every up migration in order without creating, reading
+// or writing the version table. It is meant for throwaway databases in
+// tests, which are always migrated once from empty, and does not support
+// downgrades or resuming.
+func WithoutTracking() MigratorOption {
+	return func(m *migrator) {
+		m.noTracking = true
+	}
+}
+
+// WithStatementProgress logs each statement of a SQL migration as it is
+// applied, e.g. "statement 3/12", to follow the progress of long running
+// data migrations. The number of statements in each migration is always
+// logged.
+func WithStatementProgress() MigratorOption {
+	return func(m *migrator) {
+		m.statementProgress = true
+	}
+}
+
+// WithVerbosePlan logs the files that a migration run is about to apply, in
+// order, before running the first of them, so that operators can see what an
+// upgrade will do.
+func WithVerbosePlan() MigratorOption {
+	return func(m *migrator) {
+		m.verbosePlan = true
+	}
+}
+
+// WithErrorClassifier replaces NewPostgresErrorClassifier as the judge of
+// which errors are retried or ignored.
+func WithErrorClassifier(classifier ErrorClassifier) MigratorOption {
+	return func(m *migrator) {
+		m.errorClassifier = classifier
+	}
+}
+
+// WithAllowEmpty lets the migrator run without any migrations, e.g. in tests.
+// Otherwise migrating returns ErrNoMigrations, since a binary built without
+// its migrations should not appear to have migrated successfully.
+func WithAllowEmpty() MigratorOption {
+	return func(m *migrator) {
+		m.allowEmpty = true
+	}
+}
+
+// WithQueryLogging logs every statement at debug level before it is executed,
+// replacing any substring matching one of redactPatterns with "***" so that
+// secrets embedded in seed migrations stay out of the logs.
+func WithQueryLogging(redactPatterns ...*regexp.Regexp) MigratorOption {
+	return func(m *migrator) {
+		m.logQueries = true
+		m.redactPatterns = redactPatterns
+	}
+}
+
+// WithRequireDownFiles makes migrating fail up front if any up migration has
+// no down migration. Otherwise only migrating down past such a version
+// fails, with an *IrreversibleMigrationError.
+func WithRequireDownFiles() MigratorOption {
+	return func(m *migrator) {
+		m.requireDownFiles = true
+	}
+}
+
+// WithMinSupportedVersion makes Up refuse databases that are at an older
+// version than the given one, e.g. from before a schema overhaul whose
+// migrations are no longer shipped, with an *UnsupportedVersionError. Empty
+// databases are still migrated.
+func WithMinSupportedVersion(version int) MigratorOption {
+	return func(m *migrator) {
+		m.minSupportedVersion = version
+	}
+}
+
+// WithPostMigrateAnalyze runs ANALYZE on the whole database after Up applies
+// any migrations, so that the planner does not work from statistics that
+// predate large data migrations.
+func WithPostMigrateAnalyze() MigratorOption {
+	return func(m *migrator) {
+		m.postMigrateAnalyze = true
+	}
+}
+
+// WithSchema qualifies the version tables, migrations_history and those of the
+// legacy migrators, along with migration_state, migration_timings and
+// migration_progress, with the given Postgres schema, rather than leaving
+// them to resolve through the search_path. The schema must already exist.
+// Migrations themselves are run as written.
+//
+// Unless WithLockID is also given, the migration lock is named after the
+// schema, so that the schemas of different tenants migrate in parallel while
+// migrations of each one are still serialized.
+func WithSchema(schema string) MigratorOption {
+	return func(m *migrator) {
+		m.schema = schema
+	}
+}
+
+// WithOnRetry calls onRetry before a failed transactional migration is
+// retried, with the 1-based index of the statement that failed, or 0 if the
+// failure cannot be attributed to one, and the number of the attempt about to
+// be made. Retries that eventually succeed are otherwise only logged.
+func WithOnRetry(onRetry func(version, statementIndex, attempt int, err error)) MigratorOption {
+	return func(m *migrator) {
+		m.onRetry = onRetry
+	}
+}
+
+// WithLockErrorTimeout sets how long acquiring the migration lock keeps being
+// retried while it fails with connection errors, e.g. during a brief database
+// restart, before giving up. It defaults to 30 seconds. Other errors are not
+// retried.
+func WithLockErrorTimeout(timeout time.Duration) MigratorOption {
+	return func(m *migrator) {
+		m.lockErrorTimeout = timeout
+	}
+}
+
+// WithNoTransactionSentinel runs migrations outside a transaction when their
+// contents start with the given sentinel, e.g. "-- +migrate notransaction",
+// in place of the "-- NO_TRANSACTION" comment, so that existing migration sets
+// can be used without rewriting them. Leading whitespace is ignored. The
+// "-- atc:no-transaction" header is recognised either way. The sentinel must
+// be a SQL comment, as it is left in the SQL that is run; migrating fails
+// otherwise.
+func WithNoTransactionSentinel(sentinel string) MigratorOption {
+	return func(m *migrator) {
+		if !strings.HasPrefix(strings.TrimSpace(sentinel), "--") {
+			m.configErr = fmt.Errorf("no-transaction sentinel %q is not a SQL comment starting with --", sentinel)
+			return
+		}
+
+		m.noTxSentinel = regexp.MustCompile(`^\s*` + regexp.QuoteMeta(strings.TrimSpace(sentinel)))
+	}
+}
@@ -1,20 +1,47 @@
 package migration
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
 )
 
 var noTxPrefix = regexp.MustCompile("^\\s*--\\s+(NO_TRANSACTION)")
+var noTxHeader = regexp.MustCompile(`\A(?:\s*--.*\n)*?\s*--\s*atc:no-transaction[ \t]*(?:\n|\z)`)
+var dialectHeader = regexp.MustCompile(`\A(?:\s*--.*\n)*?\s*--\s*atc:dialect[ \t]+([^\n]*)`)
+var envHeader = regexp.MustCompile(`\A(?:\s*--.*\n)*?\s*--\s*atc:env[ \t]+([^\n]*)`)
+var goBatchesHeader = regexp.MustCompile(`\A(?:\s*--.*\n)*?\s*--\s+GO_BATCHES\b`)
+var expectRowsAnnotation = regexp.MustCompile(`(?m)^\s*--\s*expect:\s*rows\s*>\s*0\s*$`)
+var goBatchSeparator = regexp.MustCompile(`(?i)\AGO[ \t]*(?:\n|\z)`)
 var migrationDirection = regexp.MustCompile("\\.(up|down)\\.")
+var migrationVersion = regexp.MustCompile(`^(\d+)`)
+var migrationFilename = regexp.MustCompile(`^\d+_(.*?)\.(up|down)\.`)
 var goMigrationFuncName = regexp.MustCompile("(Up|Down)_[0-9]*")
+var transactionControl = regexp.MustCompile("(?is)^(BEGIN|START\\s+TRANSACTION|COMMIT|END|ROLLBACK|ABORT)\\b")
+var rollbackToSavepoint = regexp.MustCompile("(?is)^ROLLBACK\\s+(WORK\\s+|TRANSACTION\\s+)?TO\\b")
+var dollarQuoteTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z_0-9]*)?\$`)
+var createIndexConcurrently = regexp.MustCompile(`(?is)CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\s+(?:IF\s+NOT\s+EXISTS\s+)?("[^"]+"|\w+)`)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
 
 var ErrCouldNotParseDirection = errors.New("could not parse direction for migration")
+var ErrCouldNotParseVersion = errors.New("could not parse version for migration")
 
 type Parser struct {
 	bindata Bindata
+
+	templateData  map[string]string
+	stripComments bool
+
+	// noTxSentinel marks migrations to run outside a transaction in place of
+	// noTxPrefix, if set.
+	noTxSentinel *regexp.Regexp
 }
 
 func NewParser(bindata Bindata) *Parser {
@@ -29,6 +56,8 @@ func (p *Parser) ParseMigrationFilename(fileName string) (migration, error) {
 		err       error
 	)
 
+	migration.Filename = fileName
+
 	migration.Direction, err = determineDirection(fileName)
 	if err != nil {
 		return migration, err
@@ -55,29 +84,131 @@ func (p *Parser) ParseFileToMigration(migrationName string) (migration, error) {
 		return migration, err
 	}
 
+	err = checkAssetIntegrity(migrationName, migrationBytes)
+	if err != nil {
+		return migration, err
+	}
+
+	migrationBytes = normalizeContents(migrationBytes)
+
+	if strings.HasSuffix(migrationName, ".tmpl") {
+		migrationBytes, err = p.renderTemplate(migrationName, migrationBytes)
+		if err != nil {
+			return migration, err
+		}
+	}
+
 	migrationContents = string(migrationBytes)
-	migration.Strategy = determineMigrationStrategy(migrationName, migrationContents)
+	migration.Strategy = determineMigrationStrategy(migrationName, migrationContents, p.noTxSentinel)
+
+	if migration.Strategy != GoMigration {
+		migration.Dialects = determineDialects(migrationContents)
+		migration.Environments = determineEnvironments(migrationContents)
+	}
 
 	switch migration.Strategy {
 	case GoMigration:
 		migration.Name = goMigrationFuncName.FindString(migrationContents)
 	case SQLNoTransaction:
-		migration.Statements = []string{migrationContents}
+		if goBatchesHeader.MatchString(migrationContents) {
+			return migration, fmt.Errorf("failed to parse migration %s: GO_BATCHES is not supported with NO_TRANSACTION", migrationName)
+		}
+
+		_, err = splitOnSemicolons(migrationContents)
+		if err != nil {
+			return migration, fmt.Errorf("failed to parse migration %s: %v", migrationName, err)
+		}
+
+		migration.Statements = []Statement{{
+			SQL:  migrationContents,
+			Line: lineNumberAt(migrationContents, len(migrationContents)-len(strings.TrimLeftFunc(migrationContents, unicode.IsSpace))),
+		}}
 		migration.Name = migrationName
 	case SQLTransaction:
-		migration.Statements = splitStatements(migrationContents)
+		if goBatchesHeader.MatchString(migrationContents) {
+			migration.Statements, err = splitGoBatches(migrationContents)
+			if err != nil {
+				return migration, fmt.Errorf("failed to parse migration %s: %v", migrationName, err)
+			}
+
+			migration.Name = migrationName
+			break
+		}
+
+		migration.Statements, err = splitStatements(migrationContents)
+		if err != nil {
+			return migration, fmt.Errorf("failed to parse migration %s: %v", migrationName, err)
+		}
+
+		if p.stripComments {
+			for i, statement := range migration.Statements {
+				migration.Statements[i].SQL = stripComments(statement.SQL)
+			}
+		}
 		migration.Name = migrationName
 	}
 
 	return migration, nil
 }
 
+// checkAssetIntegrity fails for contents that cannot be the text of a
+// migration, e.g. when a broken build embedded compressed or truncated data,
+// which would otherwise be split into nonsensical statements. Empty files and
+// files of nothing but comments are valid, as no-op migrations.
+func checkAssetIntegrity(migrationName string, contents []byte) error {
+	if !utf8.Valid(contents) {
+		return fmt.Errorf("migration asset %s appears corrupt: it is not valid UTF-8", migrationName)
+	}
+
+	if bytes.IndexByte(contents, 0) != -1 {
+		return fmt.Errorf("migration asset %s appears corrupt: it contains NUL bytes", migrationName)
+	}
+
+	return nil
+}
+
+// normalizeContents strips a leading UTF-8 byte order mark and converts CRLF
+// line endings to LF, as left behind by some Windows editors.
+func normalizeContents(contents []byte) []byte {
+	contents = bytes.TrimPrefix(contents, utf8BOM)
+	return bytes.Replace(contents, []byte("\r\n"), []byte("\n"), -1)
+}
+
+func (p *Parser) renderTemplate(migrationName string, contents []byte) ([]byte, error) {
+	tmpl, err := template.New(migrationName).Option("missingkey=error").Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse migration template %s: %v", migrationName, err)
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, p.templateData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render migration template %s: %v", migrationName, err)
+	}
+
+	return rendered.Bytes(), nil
+}
+
 func schemaVersion(assetName string) (int, error) {
-	regex := regexp.MustCompile("(\\d+)")
-	match := regex.FindStringSubmatch(assetName)
+	match := migrationVersion.FindStringSubmatch(assetName)
+	if len(match) < 2 {
+		return 0, ErrCouldNotParseVersion
+	}
+
 	return strconv.Atoi(match[1])
 }
 
+// migrationName returns the name of a migration file without its version and
+// extensions, e.g. "add_pipelines" for 1520000000_add_pipelines.up.sql.
+func migrationName(fileName string) string {
+	matches := migrationFilename.FindStringSubmatch(fileName)
+	if len(matches) < 2 {
+		return ""
+	}
+
+	return matches[1]
+}
+
 func determineDirection(migrationName string) (string, error) {
 	matches := migrationDirection.FindStringSubmatch(migrationName)
 	if len(matches) < 2 {
@@ -87,51 +218,422 @@ func determineDirection(migrationName string) (string, error) {
 	return matches[1], nil
 }
 
-func determineMigrationStrategy(migrationName string, migrationContents string) Strategy {
+func determineMigrationStrategy(migrationName string, migrationContents string, noTxSentinel *regexp.Regexp) Strategy {
+	if noTxSentinel == nil {
+		noTxSentinel = noTxPrefix
+	}
+
 	if strings.HasSuffix(migrationName, ".go") {
 		return GoMigration
 	} else {
-		if noTxPrefix.MatchString(migrationContents) {
+		// the "-- atc:no-transaction" header may appear anywhere among the
+		// leading comments, unlike the older NO_TRANSACTION sentinel
+		if noTxSentinel.MatchString(migrationContents) || noTxHeader.MatchString(migrationContents) {
 			return SQLNoTransaction
 		}
 	}
 	return SQLTransaction
 }
 
-func splitStatements(migrationContents string) []string {
-	var (
-		fileStatements      []string
-		migrationStatements []string
-	)
-	fileStatements = append(fileStatements, strings.Split(migrationContents, ";")...)
-	// last string is empty
-	if strings.TrimSpace(fileStatements[len(fileStatements)-1]) == "" {
-		fileStatements = fileStatements[:len(fileStatements)-1]
+// determineDialects returns the names listed by an "-- atc:dialect" header
+// among the leading comments of a migration, separated by spaces or commas,
+// or nil if there is none.
+func determineDialects(migrationContents string) []string {
+	return headerList(dialectHeader, migrationContents)
+}
+
+// determineEnvironments returns the environments listed by an "-- atc:env"
+// header among the leading comments of a migration, like determineDialects.
+func determineEnvironments(migrationContents string) []string {
+	return headerList(envHeader, migrationContents)
+}
+
+func headerList(header *regexp.Regexp, migrationContents string) []string {
+	matches := header.FindStringSubmatch(migrationContents)
+	if matches == nil {
+		return nil
 	}
 
-	var isSqlStatement bool = false
-	var sqlStatement string
-	for _, statement := range fileStatements {
-		statement = strings.TrimSpace(statement)
+	return strings.FieldsFunc(matches[1], func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// isTransactionControl reports whether a statement would begin or end the
+// transaction that the migrator wraps around a transactional migration.
+func isTransactionControl(statement string) bool {
+	return transactionControl.MatchString(statement) && !rollbackToSavepoint.MatchString(statement)
+}
+
+// concurrentIndexNames returns the names of the indexes created with CREATE
+// INDEX CONCURRENTLY in the given SQL, as written (including quotes).
+func concurrentIndexNames(sql string) []string {
+	names := []string{}
+	for _, match := range createIndexConcurrently.FindAllStringSubmatch(sql, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+func lineNumberAt(contents string, offset int) int {
+	return strings.Count(contents[:offset], "\n") + 1
+}
+
+func splitStatements(migrationContents string) ([]Statement, error) {
+	statements, err := splitIntoStatements(migrationContents)
+	if err != nil {
+		return nil, err
+	}
 
-		if statement == "BEGIN" || statement == "COMMIT" {
+	// bare BEGIN and COMMIT pairs are left over from migrations run by hand,
+	// some of which wrap each of their statements in a block of its own. The
+	// migrator's transaction replaces them, running the blocks together, as
+	// long as each BEGIN is matched by a COMMIT before the next one.
+	var migrationStatements []Statement
+	var begin *Statement
+	for i, statement := range statements {
+		switch {
+		case begin == nil && strings.EqualFold(statement.SQL, "BEGIN"):
+			begin = &statements[i]
 			continue
+		case begin != nil && strings.EqualFold(statement.SQL, "COMMIT"):
+			begin = nil
+			continue
+		case isTransactionControl(statement.SQL):
+			return nil, fmt.Errorf("unsupported transaction control statement '%s' at line %d; use NO_TRANSACTION to manage transactions explicitly", statement.SQL, statement.Line)
+		}
+
+		migrationStatements = append(migrationStatements, statement)
+	}
+
+	if begin != nil {
+		return nil, fmt.Errorf("unmatched transaction control statement '%s' at line %d: it has no COMMIT; use NO_TRANSACTION to manage transactions explicitly", begin.SQL, begin.Line)
+	}
+
+	return migrationStatements, nil
+}
+
+// splitGoBatches splits SQL written for SQL Server tooling, where a line
+// holding only GO ends a batch, into one statement per non-empty batch.
+// Batches may hold several statements and are executed as they are; files
+// opt in with a "-- GO_BATCHES" comment before their first statement.
+func splitGoBatches(contents string) ([]Statement, error) {
+	separators, err := scanSQL(contents, goBatchSeparatorAt)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []Statement
+
+	start := 0
+	for _, separator := range append(separators, [2]int{len(contents), len(contents)}) {
+		batch := contents[start:separator[0]]
+		leading := leadingSpaceAndComments(batch)
+
+		if sql := strings.TrimSpace(batch[leading:]); sql != "" {
+			statements = append(statements, Statement{
+				SQL:  sql,
+				Line: lineNumberAt(contents, start+leading),
+			})
 		}
-		if strings.Contains(statement, "BEGIN") {
-			isSqlStatement = true
-			sqlStatement = statement + ";"
-		} else {
-
-			if isSqlStatement {
-				sqlStatement = strings.Join([]string{sqlStatement, statement, ";"}, "")
-				if strings.HasPrefix(statement, "$$") {
-					migrationStatements = append(migrationStatements, sqlStatement)
-					isSqlStatement = false
-				}
+
+		start = separator[1]
+	}
+
+	return statements, nil
+}
+
+// goBatchSeparatorAt returns the length of the line holding only GO that
+// starts at offset, up to its line break, or 0 if there is none.
+func goBatchSeparatorAt(contents string, offset int) int {
+	if !isLineStart(contents, offset) {
+		return 0
+	}
+
+	match := goBatchSeparator.FindString(contents[offset:])
+	return len(strings.TrimSuffix(match, "\n"))
+}
+
+// splitIntoStatements splits SQL into its non-empty statements, each with
+// the line it starts on.
+func splitIntoStatements(contents string) ([]Statement, error) {
+	pieces, err := splitOnSemicolons(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []Statement
+	offset := 0
+	for _, piece := range pieces {
+		leading := leadingSpaceAndComments(piece)
+		statement := Statement{
+			SQL:        strings.TrimSpace(piece[leading:]),
+			Line:       lineNumberAt(contents, offset+leading),
+			ExpectRows: expectRowsAnnotation.MatchString(piece[:leading]),
+		}
+		offset += len(piece) + 1
+
+		if statement.SQL == "" {
+			continue
+		}
+
+		statements = append(statements, statement)
+	}
+
+	return statements, nil
+}
+
+// splitOnSemicolons splits SQL on the semicolons that end statements,
+// ignoring any within quoted strings and identifiers, dollar-quoted bodies
+// (e.g. functions) and comments. The pieces do not include the semicolons.
+func splitOnSemicolons(contents string) ([]string, error) {
+	separators, err := scanSQL(contents, func(contents string, offset int) int {
+		if contents[offset] == ';' {
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pieces []string
+
+	start := 0
+	for _, separator := range separators {
+		pieces = append(pieces, contents[start:separator[0]])
+		start = separator[1]
+	}
+
+	return append(pieces, contents[start:]), nil
+}
+
+// scanSQL returns the start and end offsets of the separators in SQL, as
+// found by separatorAt, which returns the length of a separator starting at
+// an offset or 0. Offsets within quoted strings, dollar quotes and comments
+// are skipped, so that separators in them are not mistaken for real ones.
+func scanSQL(contents string, separatorAt func(contents string, offset int) int) ([][2]int, error) {
+	var separators [][2]int
+
+	for i := 0; i < len(contents); i++ {
+		var (
+			end int
+			ok  bool
+		)
+
+		if length := separatorAt(contents, i); length > 0 {
+			separators = append(separators, [2]int{i, i + length})
+			i += length - 1
+			continue
+		}
+
+		switch {
+		case contents[i] == '\'':
+			end, ok = skipQuoted(contents, i, '\'', isEscapeString(contents, i))
+		case contents[i] == '"':
+			end, ok = skipQuoted(contents, i, '"', false)
+		case strings.HasPrefix(contents[i:], "--"):
+			end = strings.Index(contents[i:], "\n")
+			if end == -1 {
+				end = len(contents)
 			} else {
-				migrationStatements = append(migrationStatements, statement)
+				end += i
+			}
+			ok = true
+		case strings.HasPrefix(contents[i:], "/*"):
+			end, ok = skipBlockComment(contents, i)
+		case contents[i] == '\\' && isLineStart(contents, i):
+			return nil, fmt.Errorf("psql meta-commands are not supported: '%s' at line %d", metaCommandAt(contents, i), lineNumberAt(contents, i))
+		case contents[i] == '$' && (i == 0 || !isIdentifierChar(contents[i-1])):
+			tag := dollarQuoteTag.FindString(contents[i:])
+			if tag == "" {
+				continue
 			}
+
+			closing := strings.Index(contents[i+len(tag):], tag)
+			if closing == -1 {
+				return nil, fmt.Errorf("unterminated dollar-quoted string starting at line %d", lineNumberAt(contents, i))
+			}
+
+			end, ok = i+len(tag)+closing+len(tag)-1, true
+		default:
+			continue
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("unterminated quoted string or comment starting at line %d", lineNumberAt(contents, i))
 		}
+
+		i = end
 	}
-	return migrationStatements
+
+	return separators, nil
+}
+
+// stripComments removes the comments from a statement, other than optimizer
+// hints written as /*+ ... */, leaving quoted strings and identifiers and
+// dollar-quoted bodies alone. Block comments are replaced with a space so
+// that the tokens around them stay apart.
+func stripComments(statement string) string {
+	var stripped bytes.Buffer
+
+	start := 0
+	for i := 0; i < len(statement); i++ {
+		end, ok := i, false
+
+		switch {
+		case statement[i] == '\'':
+			end, ok = skipQuoted(statement, i, '\'', isEscapeString(statement, i))
+		case statement[i] == '"':
+			end, ok = skipQuoted(statement, i, '"', false)
+		case statement[i] == '$' && (i == 0 || !isIdentifierChar(statement[i-1])):
+			tag := dollarQuoteTag.FindString(statement[i:])
+			if tag == "" {
+				continue
+			}
+
+			closing := strings.Index(statement[i+len(tag):], tag)
+			end, ok = i+len(tag)+closing+len(tag)-1, closing != -1
+		case strings.HasPrefix(statement[i:], "--"):
+			stripped.WriteString(statement[start:i])
+
+			newline := strings.Index(statement[i:], "\n")
+			if newline == -1 {
+				start = len(statement)
+				i = len(statement)
+				continue
+			}
+
+			start = i + newline
+			i = start - 1
+			continue
+		case strings.HasPrefix(statement[i:], "/*") && !strings.HasPrefix(statement[i:], "/*+"):
+			end, ok = skipBlockComment(statement, i)
+			if !ok {
+				continue
+			}
+
+			stripped.WriteString(statement[start:i])
+			stripped.WriteString(" ")
+			start = end + 1
+			i = end
+			continue
+		case strings.HasPrefix(statement[i:], "/*+"):
+			end, ok = skipBlockComment(statement, i)
+		default:
+			continue
+		}
+
+		if ok {
+			i = end
+		}
+	}
+
+	stripped.WriteString(statement[start:])
+
+	return strings.TrimSpace(stripped.String())
+}
+
+// isLineStart reports whether only spaces and tabs precede offset on its line.
+func isLineStart(contents string, offset int) bool {
+	for i := offset - 1; i >= 0; i-- {
+		switch contents[i] {
+		case ' ', '\t':
+			continue
+		case '\n':
+			return true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func metaCommandAt(contents string, offset int) string {
+	line := contents[offset:]
+	if newline := strings.Index(line, "\n"); newline != -1 {
+		line = line[:newline]
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// leadingSpaceAndComments returns the length of the whitespace and comments
+// preceding the first token of a statement, so that a statement is
+// classified (and reported) by its SQL rather than by a comment above it.
+func leadingSpaceAndComments(statement string) int {
+	i := 0
+	for i < len(statement) {
+		switch {
+		case unicode.IsSpace(rune(statement[i])):
+			i++
+		case strings.HasPrefix(statement[i:], "--"):
+			newline := strings.Index(statement[i:], "\n")
+			if newline == -1 {
+				return len(statement)
+			}
+			i += newline + 1
+		case strings.HasPrefix(statement[i:], "/*"):
+			end, ok := skipBlockComment(statement, i)
+			if !ok {
+				return i
+			}
+			i = end + 1
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// skipQuoted returns the offset of the quote closing the string or identifier
+// opened at start. Doubled quotes are escapes, as are backslashes in E'...'
+// strings.
+func skipQuoted(contents string, start int, quote byte, backslashEscapes bool) (int, bool) {
+	for i := start + 1; i < len(contents); i++ {
+		switch {
+		case backslashEscapes && contents[i] == '\\':
+			i++
+		case contents[i] == quote:
+			if i+1 < len(contents) && contents[i+1] == quote {
+				i++
+				continue
+			}
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// skipBlockComment returns the offset of the final character of the block
+// comment opened at start. Postgres allows block comments to nest.
+func skipBlockComment(contents string, start int) (int, bool) {
+	depth := 0
+	for i := start; i < len(contents)-1; i++ {
+		switch contents[i : i+2] {
+		case "/*":
+			depth++
+			i++
+		case "*/":
+			depth--
+			i++
+			if depth == 0 {
+				return i, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func isEscapeString(contents string, quote int) bool {
+	return quote > 0 && (contents[quote-1] == 'E' || contents[quote-1] == 'e') &&
+		(quote == 1 || !isIdentifierChar(contents[quote-2]))
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= 0x80
 }
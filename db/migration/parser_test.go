@@ -45,6 +45,11 @@ var _ = Describe("Parser", func() {
 		Expect(upMigration.Direction).To(Equal("up"))
 	})
 
+	It("errors for a file name without a version", func() {
+		_, err := parser.ParseMigrationFilename("README.up.sql")
+		Expect(err).To(Equal(migration.ErrCouldNotParseVersion))
+	})
+
 	It("parses the strategy of the migration from the file", func() {
 		downMigration, err := parser.ParseFileToMigration("2000_some_migration.down.go")
 		Expect(err).ToNot(HaveOccurred())
@@ -82,7 +87,321 @@ var _ = Describe("Parser", func() {
 			migration, err := parser.ParseFileToMigration("1234_create_and_alter_table.up.sql")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(len(migration.Statements)).To(Equal(2))
-			Expect(migration.Statements[0]).ToNot(Equal("BEGIN"))
+			Expect(migration.Statements[0].SQL).ToNot(Equal("BEGIN"))
+		})
+
+		It("removes lowercase begin and commit statements", func() {
+			bindata.AssetReturns([]byte(`
+				begin;
+				CREATE TABLE some_table (ID integer);
+				commit;`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(1))
+			Expect(migration.Statements[0].SQL).To(Equal("CREATE TABLE some_table (ID integer)"))
+		})
+
+		It("rejects a BEGIN that starts a differently configured transaction", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN ISOLATION LEVEL SERIALIZABLE;
+				CREATE TABLE some_table (ID integer);
+				COMMIT;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("1234_create_table.up.sql"))
+			Expect(err.Error()).To(ContainSubstring("BEGIN ISOLATION LEVEL SERIALIZABLE"))
+		})
+
+		It("rejects a COMMIT that the migrator cannot strip", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				CREATE TABLE some_table (ID integer);
+				COMMIT WORK;
+				ALTER TABLE some_table ADD COLUMN notes varchar;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("COMMIT WORK"))
+		})
+
+		It("rejects a bare BEGIN halfway through the file", func() {
+			bindata.AssetReturns([]byte(`
+				CREATE TABLE some_table (ID integer);
+				BEGIN;
+				ALTER TABLE some_table ADD COLUMN notes varchar;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("'BEGIN' at line 3"))
+		})
+
+		It("rejects a bare COMMIT halfway through the file", func() {
+			bindata.AssetReturns([]byte(`
+				CREATE TABLE some_table (ID integer);
+				COMMIT;
+				ALTER TABLE some_table ADD COLUMN notes varchar;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("'COMMIT' at line 3"))
+		})
+
+		It("rejects a BEGIN nested in another", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				CREATE TABLE some_table (ID integer);
+				BEGIN;
+				ALTER TABLE some_table ADD COLUMN notes varchar;
+				COMMIT;
+				COMMIT;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("'BEGIN' at line 4"))
+		})
+
+		It("strips the BEGIN and COMMIT of every block in the file", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				CREATE TABLE some_table (ID integer);
+				COMMIT;
+
+				BEGIN;
+				ALTER TABLE some_table ADD COLUMN notes varchar;
+				COMMIT;`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(migration.Statements).To(HaveLen(2))
+			Expect(migration.Statements[0].SQL).To(Equal("CREATE TABLE some_table (ID integer)"))
+			Expect(migration.Statements[1].SQL).To(Equal("ALTER TABLE some_table ADD COLUMN notes varchar"))
+		})
+
+		It("rejects statements that end the transaction early", func() {
+			for _, statement := range []string{"START TRANSACTION", "END", "ROLLBACK", "ABORT"} {
+				bindata.AssetReturns([]byte(statement+`;
+				CREATE TABLE some_table (ID integer);`), nil)
+
+				_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+				Expect(err).To(HaveOccurred(), statement)
+			}
+		})
+
+		It("allows rolling back to a savepoint", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				SAVEPOINT before_insert;
+				INSERT INTO some_table (ID) VALUES (1);
+				ROLLBACK TO SAVEPOINT before_insert;
+				COMMIT;`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(3))
+		})
+
+		It("records the line each statement starts on", func() {
+			bindata.AssetReturns([]byte(`BEGIN;
+  CREATE TABLE some_table (
+    id integer,
+    something varchar
+  );
+
+  CREATE OR REPLACE FUNCTION on_insert() RETURNS TRIGGER AS $$
+  BEGIN
+    RETURN NULL;
+  END;
+  $$ LANGUAGE plpgsql;
+
+  ALTER TABLE some_table ADD COLUMN notes varchar; ALTER TABLE some_table ADD COLUMN more_notes varchar;
+COMMIT;
+`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(4))
+			Expect(migration.Statements[0].Line).To(Equal(2))
+			Expect(migration.Statements[1].Line).To(Equal(7))
+			Expect(migration.Statements[2].Line).To(Equal(13))
+			Expect(migration.Statements[3].Line).To(Equal(13))
+		})
+
+		It("does not split a CTE on semicolons inside string literals", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				WITH tagged AS (
+				  SELECT id, 'a;b' AS tag FROM builds
+				), escaped AS (
+				  SELECT id, 'it''s; fine' AS note, E'back\'slash;' AS other FROM tagged
+				)
+				INSERT INTO build_notes (build_id, note)
+				SELECT id, note || ';' FROM escaped;
+				UPDATE builds SET name = "weird;column" FROM build_notes;
+				COMMIT;`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_backfill_notes.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(2))
+			Expect(migration.Statements[0].SQL).To(HavePrefix("WITH tagged AS ("))
+			Expect(migration.Statements[0].SQL).To(HaveSuffix("SELECT id, note || ';' FROM escaped"))
+			Expect(migration.Statements[1].SQL).To(Equal(`UPDATE builds SET name = "weird;column" FROM build_notes`))
+		})
+
+		It("does not split on semicolons inside dollar quotes or comments", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				CREATE FUNCTION noop() RETURNS void AS $body$
+				BEGIN
+				  PERFORM 1; -- $$ inside the body
+				END;
+				$body$ LANGUAGE plpgsql;
+				/* a commented out statement; */
+				-- DROP TABLE builds;
+				COMMIT;`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_function.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(1))
+			Expect(migration.Statements[0].SQL).To(HaveSuffix("$body$ LANGUAGE plpgsql"))
+		})
+
+		It("rejects an unterminated string literal", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				INSERT INTO teams (name) VALUES ('main);
+				COMMIT;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_insert_team.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("line 3"))
+		})
+
+		It("rejects psql meta-commands", func() {
+			bindata.AssetReturns([]byte(`
+				BEGIN;
+				CREATE TABLE some_table (ID integer);
+				\i somefile.sql
+				COMMIT;`), nil)
+
+			_, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("psql meta-commands are not supported"))
+			Expect(err.Error()).To(ContainSubstring("1234_create_table.up.sql"))
+			Expect(err.Error()).To(ContainSubstring(`'\i somefile.sql' at line 4`))
+		})
+
+		It("allows backslashes inside string literals", func() {
+			bindata.AssetReturns([]byte(`
+				INSERT INTO some_table (path) VALUES ('
+\not\a\meta\command');`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_insert_path.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(1))
+		})
+
+		It("parses expectations on the rows a statement affects", func() {
+			bindata.AssetReturns([]byte(`UPDATE teams SET name = 'main' WHERE id = 1;
+-- correct the legacy name
+-- expect: rows>0
+UPDATE teams SET name = 'other' WHERE name = 'legacy';
+`), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_fix_team_names.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(migration.Statements).To(HaveLen(2))
+			Expect(migration.Statements[0].ExpectRows).To(BeFalse())
+			Expect(migration.Statements[1].ExpectRows).To(BeTrue())
+			Expect(migration.Statements[1].Line).To(Equal(4))
+		})
+
+		It("fails for an asset that is not valid UTF-8", func() {
+			bindata.AssetReturns([]byte("\x1f\x8b\x08\x00\xff\xfe CREATE TABLE"), nil)
+
+			_, err := parser.ParseFileToMigration("1000_some_migration.up.sql")
+			Expect(err).To(MatchError("migration asset 1000_some_migration.up.sql appears corrupt: it is not valid UTF-8"))
+		})
+
+		It("fails for an asset containing NUL bytes", func() {
+			bindata.AssetReturns([]byte("CREATE TABLE some_table (id integer);\x00\x00\x00"), nil)
+
+			_, err := parser.ParseFileToMigration("1000_some_migration.up.sql")
+			Expect(err).To(MatchError("migration asset 1000_some_migration.up.sql appears corrupt: it contains NUL bytes"))
+		})
+
+		It("normalizes CRLF line endings", func() {
+			bindata.AssetReturns([]byte("BEGIN;\r\nCREATE TABLE some_table (ID integer);\r\nALTER TABLE some_table ADD COLUMN notes varchar;\r\nCOMMIT;\r\n"), nil)
+
+			migration, err := parser.ParseFileToMigration("1234_create_and_alter_table.up.sql")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(migration.Statements)).To(Equal(2))
+			Expect(migration.Statements[0].SQL).To(Equal("CREATE TABLE some_table (ID integer)"))
+			Expect(migration.Statements[1].SQL).To(Equal("ALTER TABLE some_table ADD COLUMN notes varchar"))
+			Expect(migration.Statements[1].Line).To(Equal(3))
+		})
+
+		Context("GO batch separators", func() {
+			It("splits on lines holding only GO when the file opts in", func() {
+				bindata.AssetReturns([]byte(`-- imported from SQL Server tooling
+-- GO_BATCHES
+CREATE TABLE some_table (id integer);
+INSERT INTO some_table (id) VALUES (1);
+GO
+CREATE FUNCTION going() RETURNS text AS 'SELECT ''GO''' LANGUAGE sql;
+  go
+`), nil)
+
+				migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(migration.Statements).To(HaveLen(2))
+				Expect(migration.Statements[0].SQL).To(Equal("CREATE TABLE some_table (id integer);\nINSERT INTO some_table (id) VALUES (1);"))
+				Expect(migration.Statements[0].Line).To(Equal(3))
+				Expect(migration.Statements[1].SQL).To(Equal("CREATE FUNCTION going() RETURNS text AS 'SELECT ''GO''' LANGUAGE sql;"))
+				Expect(migration.Statements[1].Line).To(Equal(6))
+			})
+
+			It("does not split on GO lines inside quotes", func() {
+				bindata.AssetReturns([]byte(`-- GO_BATCHES
+CREATE FUNCTION stop() RETURNS void AS $$
+BEGIN
+GO
+END;
+$$ LANGUAGE plpgsql;
+INSERT INTO notes (text) VALUES ('ready
+go
+');
+GO
+`), nil)
+
+				migration, err := parser.ParseFileToMigration("1234_create_function.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(migration.Statements).To(HaveLen(1))
+				Expect(migration.Statements[0].SQL).To(HavePrefix("CREATE FUNCTION stop()"))
+				Expect(migration.Statements[0].SQL).To(HaveSuffix("VALUES ('ready\ngo\n');"))
+			})
+
+			It("splits on semicolons without the header", func() {
+				bindata.AssetReturns([]byte(`CREATE TABLE some_table (id integer);
+INSERT INTO some_table (id) VALUES (1);
+`), nil)
+
+				migration, err := parser.ParseFileToMigration("1234_create_table.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(migration.Statements).To(HaveLen(2))
+			})
+
+			It("rejects GO batches in NO_TRANSACTION migrations", func() {
+				bindata.AssetReturns([]byte(`-- NO_TRANSACTION
+-- GO_BATCHES
+CREATE INDEX CONCURRENTLY some_index ON some_table (id);
+GO
+`), nil)
+
+				_, err := parser.ParseFileToMigration("1234_create_index.up.sql")
+				Expect(err).To(MatchError(ContainSubstring("GO_BATCHES is not supported with NO_TRANSACTION")))
+			})
 		})
 
 		Context("No transactions", func() {
@@ -93,6 +412,80 @@ var _ = Describe("Parser", func() {
 				Expect(err).ToNot(HaveOccurred())
 				Expect(len(migration.Statements)).To(Equal(1))
 			})
+
+			It("rejects psql meta-commands", func() {
+				bindata.AssetReturns([]byte(`-- NO_TRANSACTION
+\connect other_database
+CREATE INDEX CONCURRENTLY some_index ON some_table (id);`), nil)
+
+				_, err := parser.ParseFileToMigration("3000_some_no_transaction_migration.up.sql")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`psql meta-commands are not supported: '\connect other_database' at line 2`))
+			})
+
+			It("detects NO_TRANSACTION after a byte order mark", func() {
+				bindata.AssetReturns([]byte("\xef\xbb\xbf-- NO_TRANSACTION\r\nCREATE INDEX CONCURRENTLY some_index ON some_table (id);\r\n"), nil)
+
+				noTxMigration, err := parser.ParseFileToMigration("3000_some_no_transaction_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(noTxMigration.Strategy).To(Equal(migration.SQLNoTransaction))
+				Expect(noTxMigration.Statements[0].SQL).ToNot(ContainSubstring("\r"))
+				Expect(noTxMigration.Statements[0].SQL).To(HavePrefix("-- NO_TRANSACTION\n"))
+			})
+
+			It("detects the atc:no-transaction header among the leading comments", func() {
+				bindata.AssetReturns([]byte(`-- adds an index without locking writes
+-- atc:no-transaction
+CREATE INDEX CONCURRENTLY some_index ON some_table (id);`), nil)
+
+				noTxMigration, err := parser.ParseFileToMigration("3000_some_no_transaction_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(noTxMigration.Strategy).To(Equal(migration.SQLNoTransaction))
+			})
+
+			It("does not detect the atc:no-transaction header after the first statement", func() {
+				bindata.AssetReturns([]byte(`CREATE TABLE some_table (id integer);
+-- atc:no-transaction
+CREATE INDEX some_index ON some_table (id);`), nil)
+
+				txMigration, err := parser.ParseFileToMigration("3000_some_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txMigration.Strategy).To(Equal(migration.SQLTransaction))
+			})
+		})
+
+		Context("with an atc:dialect header", func() {
+			It("lists the dialects the migration runs on", func() {
+				bindata.AssetReturns([]byte(`-- documents the table in the catalog
+-- atc:dialect postgres, cockroach
+COMMENT ON TABLE some_table IS 'some table';`), nil)
+
+				dialectMigration, err := parser.ParseFileToMigration("3000_some_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(dialectMigration.Dialects).To(Equal([]string{"postgres", "cockroach"}))
+			})
+
+			It("runs on every dialect without one", func() {
+				bindata.AssetReturns([]byte(`CREATE TABLE some_table (id integer);
+-- atc:dialect postgres`), nil)
+
+				anyMigration, err := parser.ParseFileToMigration("3000_some_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(anyMigration.Dialects).To(BeEmpty())
+			})
+		})
+
+		Context("with an atc:env header", func() {
+			It("lists the environments the migration runs in", func() {
+				bindata.AssetReturns([]byte(`-- atc:dialect postgres
+-- atc:env dev,staging
+INSERT INTO teams (name) VALUES ('demo');`), nil)
+
+				envMigration, err := parser.ParseFileToMigration("3000_some_migration.up.sql")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envMigration.Environments).To(Equal([]string{"dev", "staging"}))
+				Expect(envMigration.Dialects).To(Equal([]string{"postgres"}))
+			})
 		})
 	})
 
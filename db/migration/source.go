@@ -1,6 +1,17 @@
 package migration
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
 	"github.com/gobuffalo/packr"
 )
 
@@ -29,3 +40,215 @@ func (bs *packrSource) AssetNames() []string {
 func (bs *packrSource) Asset(name string) ([]byte, error) {
 	return bs.Box.MustBytes(name)
 }
+
+// MergeBindata combines several sets of migrations, such as the core
+// migrations and those contributed by plugins, into a single Bindata whose
+// assets are interleaved by version. Each version may only be provided by one
+// source, and every asset must be named like a migration.
+func MergeBindata(sources ...Bindata) (Bindata, error) {
+	merged := &mergedSource{
+		sources: map[string]Bindata{},
+	}
+
+	parser := NewParser(nil)
+	owners := map[int]int{}
+	versions := map[string]int{}
+
+	for i, source := range sources {
+		for _, name := range source.AssetNames() {
+			if _, found := merged.sources[name]; found {
+				return nil, fmt.Errorf("migration %s is provided by more than one source", name)
+			}
+
+			migration, err := parser.ParseMigrationFilename(name)
+			if err != nil {
+				return nil, fmt.Errorf("migration %s is not a valid migration: %v", name, err)
+			}
+
+			if owner, found := owners[migration.Version]; found && owner != i {
+				return nil, fmt.Errorf("migration version %d is provided by more than one source", migration.Version)
+			}
+
+			owners[migration.Version] = i
+			versions[name] = migration.Version
+
+			merged.sources[name] = source
+			merged.names = append(merged.names, name)
+		}
+	}
+
+	sort.SliceStable(merged.names, func(i, j int) bool {
+		return versions[merged.names[i]] < versions[merged.names[j]]
+	})
+
+	return merged, nil
+}
+
+type mergedSource struct {
+	names   []string
+	sources map[string]Bindata
+}
+
+func (ms *mergedSource) AssetNames() []string {
+	return ms.names
+}
+
+func (ms *mergedSource) Asset(name string) ([]byte, error) {
+	source, found := ms.sources[name]
+	if !found {
+		return nil, fmt.Errorf("migration %s not found", name)
+	}
+
+	return source.Asset(name)
+}
+
+// OpenArchiveBindata reads the migrations in the .zip, .tar.gz or .tgz
+// archive at path; see ReadZipBindata and ReadTarGzBindata. The archive is
+// read once, so it may be verified beforehand without racing the migrator.
+func OpenArchiveBindata(archivePath string) (Bindata, error) {
+	contents, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(archivePath, ".zip"):
+		return ReadZipBindata(bytes.NewReader(contents), int64(len(contents)))
+	case strings.HasSuffix(archivePath, ".tar.gz"), strings.HasSuffix(archivePath, ".tgz"):
+		return ReadTarGzBindata(bytes.NewReader(contents))
+	default:
+		return nil, fmt.Errorf("unsupported migration archive %s: expected .zip, .tar.gz or .tgz", archivePath)
+	}
+}
+
+// ReadZipBindata reads the .up.sql and .down.sql files of a zip archive, in
+// any directory, as migrations. Other entries are ignored, but it fails for
+// .up.sql and .down.sql files not named like a migration.
+func ReadZipBindata(r io.ReaderAt, size int64) (Bindata, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	source := newArchiveSource()
+	for _, file := range archive.File {
+		if !file.Mode().IsRegular() || !isArchivedMigration(file.Name) {
+			continue
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		err = source.add(file.Name, entry)
+		entry.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source.sorted(), nil
+}
+
+// ReadTarGzBindata reads the .up.sql and .down.sql files of a gzipped tar
+// archive, in any directory, as migrations. Other entries are ignored, but it
+// fails for .up.sql and .down.sql files not named like a migration.
+func ReadTarGzBindata(r io.Reader) (Bindata, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer gzipReader.Close()
+
+	source := newArchiveSource()
+
+	archive := tar.NewReader(gzipReader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !header.FileInfo().Mode().IsRegular() || !isArchivedMigration(header.Name) {
+			continue
+		}
+
+		err = source.add(header.Name, archive)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source.sorted(), nil
+}
+
+func isArchivedMigration(name string) bool {
+	return strings.HasSuffix(name, ".up.sql") || strings.HasSuffix(name, ".down.sql")
+}
+
+type archiveSource struct {
+	names  []string
+	assets map[string][]byte
+}
+
+func newArchiveSource() *archiveSource {
+	return &archiveSource{assets: map[string][]byte{}}
+}
+
+func (as *archiveSource) add(entryName string, contents io.Reader) error {
+	name := path.Base(entryName)
+	if _, err := NewParser(nil).ParseMigrationFilename(name); err != nil {
+		return fmt.Errorf("archive entry %s is not a valid migration: %v", entryName, err)
+	}
+
+	if _, found := as.assets[name]; found {
+		return fmt.Errorf("migration %s appears more than once in the archive", name)
+	}
+
+	asset, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+
+	as.names = append(as.names, name)
+	as.assets[name] = asset
+
+	return nil
+}
+
+// sorted orders the migrations by version, since archives list their entries
+// in whatever order they were added.
+func (as *archiveSource) sorted() *archiveSource {
+	parser := NewParser(nil)
+	versions := map[string]int{}
+	for _, name := range as.names {
+		if migration, err := parser.ParseMigrationFilename(name); err == nil {
+			versions[name] = migration.Version
+		}
+	}
+
+	sort.SliceStable(as.names, func(i, j int) bool {
+		return versions[as.names[i]] < versions[as.names[j]]
+	})
+
+	return as
+}
+
+func (as *archiveSource) AssetNames() []string {
+	return as.names
+}
+
+func (as *archiveSource) Asset(name string) ([]byte, error) {
+	asset, found := as.assets[name]
+	if !found {
+		return nil, fmt.Errorf("migration %s not found", name)
+	}
+
+	return asset, nil
+}
@@ -0,0 +1,146 @@
+package migration_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+
+	"github.com/concourse/atc/db/migration"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergeBindata", func() {
+	var core, plugin migration.Bindata
+
+	BeforeEach(func() {
+		core = NewMapBindata(map[string]string{
+			"1000_create_teams.up.sql":   `CREATE TABLE teams (id integer);`,
+			"1000_create_teams.down.sql": `DROP TABLE teams;`,
+			"3000_create_builds.up.sql":  `CREATE TABLE builds (id integer);`,
+		})
+
+		plugin = NewMapBindata(map[string]string{
+			"2000_create_plugin_table.up.sql":   `CREATE TABLE plugin_table (id integer);`,
+			"2000_create_plugin_table.down.sql": `DROP TABLE plugin_table;`,
+			"4000_alter_plugin_table.up.sql":    `ALTER TABLE plugin_table ADD COLUMN notes varchar;`,
+		})
+	})
+
+	It("interleaves the migrations from every source by version", func() {
+		merged, err := migration.MergeBindata(core, plugin)
+		Expect(err).NotTo(HaveOccurred())
+
+		parser := migration.NewParser(merged)
+
+		versions := []int{}
+		for _, name := range merged.AssetNames() {
+			m, err := parser.ParseMigrationFilename(name)
+			Expect(err).NotTo(HaveOccurred())
+			versions = append(versions, m.Version)
+		}
+		Expect(versions).To(Equal([]int{1000, 1000, 2000, 2000, 3000, 4000}))
+
+		contents, err := merged.Asset("2000_create_plugin_table.up.sql")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(`CREATE TABLE plugin_table (id integer);`))
+	})
+
+	It("errors when two sources provide the same version", func() {
+		conflicting := NewMapBindata(map[string]string{
+			"3000_create_other_table.up.sql": `CREATE TABLE other_table (id integer);`,
+		})
+
+		_, err := migration.MergeBindata(core, conflicting)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("3000"))
+	})
+
+	It("errors when a source provides a file without a version", func() {
+		unversioned := NewMapBindata(map[string]string{
+			"notes.up.sql": `SELECT 1;`,
+		})
+
+		_, err := migration.MergeBindata(core, unversioned)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("notes.up.sql"))
+	})
+})
+
+var _ = Describe("Archive sources", func() {
+	entries := []struct {
+		name     string
+		contents string
+	}{
+		{"migrations/2000_create_builds.up.sql", `CREATE TABLE builds (id integer);`},
+		{"migrations/1000_create_teams.up.sql", `CREATE TABLE teams (id integer);`},
+		{"migrations/1000_create_teams.down.sql", `DROP TABLE teams;`},
+		{"README.md", `not a migration`},
+	}
+
+	expectMigrations := func(bindata migration.Bindata) {
+		Expect(bindata.AssetNames()).To(Equal([]string{
+			"1000_create_teams.up.sql",
+			"1000_create_teams.down.sql",
+			"2000_create_builds.up.sql",
+		}))
+
+		contents, err := bindata.Asset("2000_create_builds.up.sql")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(`CREATE TABLE builds (id integer);`))
+
+		_, err = bindata.Asset("README.md")
+		Expect(err).To(HaveOccurred())
+	}
+
+	It("reads the migrations of a zip archive sorted by version", func() {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for _, entry := range entries {
+			file, err := archive.Create(entry.name)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.Write([]byte(entry.contents))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(archive.Close()).To(Succeed())
+
+		bindata, err := migration.ReadZipBindata(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		Expect(err).NotTo(HaveOccurred())
+
+		expectMigrations(bindata)
+	})
+
+	It("reads the migrations of a gzipped tar archive sorted by version", func() {
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		archive := tar.NewWriter(gzipWriter)
+		for _, entry := range entries {
+			err := archive.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.contents)), Typeflag: tar.TypeReg})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = archive.Write([]byte(entry.contents))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(archive.Close()).To(Succeed())
+		Expect(gzipWriter.Close()).To(Succeed())
+
+		bindata, err := migration.ReadTarGzBindata(&buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		expectMigrations(bindata)
+	})
+
+	It("errors for a migration file without a version", func() {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		file, err := archive.Create("docs/README.up.sql")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = file.Write([]byte(`not a migration`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(archive.Close()).To(Succeed())
+
+		_, err = migration.ReadZipBindata(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("docs/README.up.sql"))
+	})
+})
@@ -0,0 +1,172 @@
+package migration_test
+
+import (
+	"database/sql"
+
+	"github.com/concourse/atc/db/encryption"
+	"github.com/concourse/atc/db/migration"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migrating an in-memory sqlite database", func() {
+	var (
+		db       *sql.DB
+		migrator migration.Migrator
+	)
+
+	BeforeEach(func() {
+		var err error
+		db, err = sql.Open("sqlite3", ":memory:")
+		Expect(err).NotTo(HaveOccurred())
+
+		// every connection to :memory: gets its own empty database
+		db.SetMaxOpenConns(1)
+
+		bindata := NewMapBindata(map[string]string{
+			"1000_create_teams.up.sql":       `CREATE TABLE teams (id integer PRIMARY KEY, name text);`,
+			"1000_create_teams.down.sql":     `DROP TABLE teams;`,
+			"2000_create_pipelines.up.sql":   `CREATE TABLE pipelines (id integer PRIMARY KEY, team_id integer REFERENCES teams (id));`,
+			"2000_create_pipelines.down.sql": `DROP TABLE pipelines;`,
+		})
+
+		migrator = migration.NewMigratorForMigrations(db, nil, encryption.NewNoEncryption(), bindata, migration.WithDriverName("sqlite3"))
+	})
+
+	AfterEach(func() {
+		_ = db.Close()
+	})
+
+	It("migrates up and back down", func() {
+		err := migrator.Up()
+		Expect(err).NotTo(HaveOccurred())
+
+		ExpectDatabaseMigrationVersionToEqual(migrator, 2000)
+
+		_, err = db.Exec("INSERT INTO teams (id, name) VALUES (1, 'main')")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = migrator.Migrate(1000)
+		Expect(err).NotTo(HaveOccurred())
+
+		ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='pipelines')").Scan(&exists)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+
+	It("fails to log notices, which only lib/pq connections raise", func() {
+		migrator = migration.NewMigratorForMigrations(db, nil, encryption.NewNoEncryption(), NewMapBindata(map[string]string{
+			"1000_create_teams.up.sql": `CREATE TABLE teams (id integer PRIMARY KEY, name text);`,
+		}), migration.WithDriverName("sqlite3"), migration.WithNoticeLogging())
+
+		err := migrator.Up()
+		Expect(err).To(MatchError(ContainSubstring("requires a lib/pq connection")))
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='teams')").Scan(&exists)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+})
+
+// dialectSpecificMigrations each run on only one of Postgres and sqlite, where
+// the other would fail to parse them.
+var dialectSpecificMigrations = map[string]string{
+	"1000_create_teams.up.sql": `CREATE TABLE teams (id integer PRIMARY KEY, name text);`,
+	"2000_comment_on_teams.up.sql": `-- atc:dialect postgres
+COMMENT ON TABLE teams IS 'teams';`,
+	"3000_create_team_names.up.sql": `-- atc:dialect sqlite
+CREATE TABLE team_names (id integer PRIMARY KEY AUTOINCREMENT, name text);`,
+}
+
+var _ = Describe("Migrating an in-memory sqlite database with dialect-specific migrations", func() {
+	It("runs only the migrations for sqlite, recording the others as applied", func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		Expect(err).NotTo(HaveOccurred())
+		defer db.Close()
+
+		db.SetMaxOpenConns(1)
+
+		logger := &recordingLogger{}
+		migrator := migration.NewMigratorForMigrations(db, nil, encryption.NewNoEncryption(), NewMapBindata(dialectSpecificMigrations),
+			migration.WithDriverName("sqlite3"),
+			migration.WithLogger(logger),
+		)
+
+		err = migrator.Up()
+		Expect(err).NotTo(HaveOccurred())
+
+		ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+		Expect(logger.Logs("skipping-migration-for-other-dialect")).To(HaveLen(1))
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='team_names')").Scan(&exists)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeTrue())
+	})
+})
+
+// envSpecificMigrations include demo data that is only for development.
+var envSpecificMigrations = map[string]string{
+	"1000_create_teams.up.sql": `CREATE TABLE teams (id integer PRIMARY KEY, name text);`,
+	"2000_create_demo_team.up.sql": `-- atc:env dev,staging
+INSERT INTO teams (name) VALUES ('demo');`,
+	"3000_create_team_names.up.sql": `CREATE TABLE team_names (id integer PRIMARY KEY, name text);`,
+}
+
+var _ = Describe("Migrating an in-memory sqlite database with environment-specific migrations", func() {
+	teamsIn := func(environment string) int {
+		db, err := sql.Open("sqlite3", ":memory:")
+		Expect(err).NotTo(HaveOccurred())
+		defer db.Close()
+
+		db.SetMaxOpenConns(1)
+
+		migrator := migration.NewMigratorForMigrations(db, nil, encryption.NewNoEncryption(), NewMapBindata(envSpecificMigrations),
+			migration.WithDriverName("sqlite3"),
+			migration.WithLogger(&recordingLogger{}),
+			migration.WithEnvironment(environment),
+		)
+
+		err = migrator.Up()
+		Expect(err).NotTo(HaveOccurred())
+
+		ExpectDatabaseMigrationVersionToEqual(migrator, 3000)
+
+		var teams int
+		err = db.QueryRow("SELECT COUNT(*) FROM teams").Scan(&teams)
+		Expect(err).NotTo(HaveOccurred())
+
+		return teams
+	}
+
+	It("runs the migrations for dev", func() {
+		Expect(teamsIn("dev")).To(Equal(1))
+	})
+
+	It("records the migrations for other environments as applied without running them in prod", func() {
+		Expect(teamsIn("prod")).To(BeZero())
+	})
+
+	It("fails at the first environment-specific migration when no environment is set", func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		Expect(err).NotTo(HaveOccurred())
+		defer db.Close()
+
+		db.SetMaxOpenConns(1)
+
+		migrator := migration.NewMigratorForMigrations(db, nil, encryption.NewNoEncryption(), NewMapBindata(envSpecificMigrations),
+			migration.WithDriverName("sqlite3"),
+			migration.WithLogger(&recordingLogger{}),
+		)
+
+		err = migrator.Up()
+		Expect(err).To(MatchError(ContainSubstring("migration 2000")))
+
+		ExpectDatabaseMigrationVersionToEqual(migrator, 1000)
+	})
+})
@@ -1,12 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -54,65 +54,58 @@ type Tx interface {
 	Stmt(stmt *sql.Stmt) *sql.Stmt
 }
 
-func Open(logger lager.Logger, sqlDriver string, sqlDataSource string, newKey *encryption.Key, oldKey *encryption.Key, connectionName string, lockFactory lock.LockFactory) (Conn, error) {
-	for {
-		var strategy encryption.Strategy
-		if newKey != nil {
-			strategy = newKey
-		} else {
-			strategy = encryption.NewNoEncryption()
-		}
-
-		sqlDb, err := migration.NewOpenHelper(sqlDriver, sqlDataSource, lockFactory, strategy).Open()
-		if err != nil {
-			if shouldRetry(err) {
-				logger.Error("failed-to-open-db-retrying", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-
-			return nil, err
-		}
+// Open waits for the database to accept connections, e.g. while it is still
+// starting up next to the ATC, for up to waitTimeout or forever if it is 0.
+// It then migrates the database and encrypts or decrypts its data as the
+// keys require.
+func Open(logger lager.Logger, sqlDriver string, sqlDataSource string, newKey *encryption.Key, oldKey *encryption.Key, connectionName string, lockFactory lock.LockFactory, waitTimeout time.Duration, opts ...migration.MigratorOption) (Conn, error) {
+	var strategy encryption.Strategy
+	if newKey != nil {
+		strategy = newKey
+	} else {
+		strategy = encryption.NewNoEncryption()
+	}
 
-		switch {
-		case oldKey != nil && newKey == nil:
-			err = decryptToPlaintext(logger.Session("decrypt"), sqlDb, oldKey)
-		case oldKey != nil && newKey != nil:
-			err = encryptWithNewKey(logger.Session("rotate"), sqlDb, newKey, oldKey)
-		}
-		if err != nil {
-			return nil, err
-		}
+	helper := migration.NewOpenHelper(sqlDriver, sqlDataSource, lockFactory, strategy, opts...)
 
-		if newKey != nil {
-			err = encryptPlaintext(logger.Session("encrypt"), sqlDb, newKey)
-			if err != nil {
-				return nil, err
-			}
-		}
+	logger.Debug("waiting-for-database", lager.Data{"timeout": waitTimeout.String()})
 
-		listener := pq.NewListener(sqlDataSource, time.Second, time.Minute, nil)
-
-		return &db{
-			DB: sqlDb,
+	err := helper.WaitForDatabase(context.Background(), waitTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-			bus:        NewNotificationsBus(listener, sqlDb),
-			encryption: strategy,
-			name:       connectionName,
-		}, nil
+	sqlDb, err := helper.Open()
+	if err != nil {
+		return nil, err
 	}
-}
 
-func shouldRetry(err error) bool {
-	if strings.Contains(err.Error(), "dial ") {
-		return true
+	switch {
+	case oldKey != nil && newKey == nil:
+		err = decryptToPlaintext(logger.Session("decrypt"), sqlDb, oldKey)
+	case oldKey != nil && newKey != nil:
+		err = encryptWithNewKey(logger.Session("rotate"), sqlDb, newKey, oldKey)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if pqErr, ok := err.(*pq.Error); ok {
-		return pqErr.Code.Name() == "cannot_connect_now"
+	if newKey != nil {
+		err = encryptPlaintext(logger.Session("encrypt"), sqlDb, newKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return false
+	listener := pq.NewListener(sqlDataSource, time.Second, time.Minute, nil)
+
+	return &db{
+		DB: sqlDb,
+
+		bus:        NewNotificationsBus(listener, sqlDb),
+		encryption: strategy,
+		name:       connectionName,
+	}, nil
 }
 
 var encryptedColumns = map[string]string{
@@ -107,12 +107,17 @@ func (runner *Runner) MigrateToVersion(version int) {
 }
 
 func (runner *Runner) TryOpenDBAtVersion(version int) (*sql.DB, error) {
-	dbConn, err := migration.NewOpenHelper(
+	helper := migration.NewOpenHelper(
 		"postgres",
 		runner.DataSourceName(),
 		nil,
 		encryption.NewNoEncryption(),
-	).OpenAtVersion(version)
+	)
+
+	// tests of down migrations reopen the database at an older version
+	helper.AllowDowngrade = true
+
+	dbConn, err := helper.OpenAtVersion(version)
 
 	if err != nil {
 		return nil, err
@@ -156,6 +161,7 @@ func (runner *Runner) OpenConn() db.Conn {
 		nil,
 		"postgresrunner",
 		nil,
+		0,
 	)
 	Expect(err).NotTo(HaveOccurred())
 